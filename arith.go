@@ -0,0 +1,231 @@
+package template
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+var (
+	errDivByZero = errors.New("division by zero")
+	errModByZero = errors.New("modulo by zero")
+)
+
+// A numKind is the kind of number a Value is treated as in arithmetic.
+type numKind uint8
+
+const (
+	numInt numKind = iota
+	numUint
+	numFloat
+)
+
+// numKindOf returns the kind of number v is. Floats, and strings that hold
+// a float but not an integer, are floats, unsigned integers are unsigned,
+// and anything else is coerced with Int.
+func numKindOf(v Value) numKind {
+	switch v := v.(type) {
+	case floatValue:
+		return numFloat
+	case uintValue:
+		return numUint
+	case stringValue, SafeString:
+		s := v.String()
+		if _, err := strconv.ParseInt(s, 10, 64); err != nil {
+			if _, err := strconv.ParseFloat(s, 64); err == nil {
+				return numFloat
+			}
+		}
+	case pointerValue:
+		if !v.isNil() {
+			return numKindOf(v.value())
+		}
+	}
+	return numInt
+}
+
+// arith applies the arithmetic operator op to l and r. If either is a
+// string, + concatenates them, * repeats the string and % formats the
+// string on the left as described by formatString. Otherwise l and r are
+// numbers. If either is a float, so is the result. Otherwise the result is
+// an integer, unsigned if either operand is unsigned and neither is
+// negative, and operations overflow as they do in Go. Division of integers
+// truncates towards zero. Dividing by zero is an error.
+func arith(op Token, l, r Value) (Value, error) {
+	switch {
+	case op == TokAdd && (isString(l) || isString(r)):
+		if isSafe(l) && isSafe(r) {
+			return SafeString(l.String() + r.String()), nil
+		}
+		return stringValue(l.String() + r.String()), nil
+	case op == TokMul && (isString(l) || isString(r)):
+		if isString(l) {
+			return repeatString(l, r)
+		}
+		return repeatString(r, l)
+	case op == TokRem && isString(l):
+		return formatString(l.String(), r), nil
+	}
+	lk, rk := numKindOf(l), numKindOf(r)
+	switch {
+	case lk == numFloat || rk == numFloat:
+		return arithFloat(op, l.Float(), r.Float())
+	case (lk == numUint || rk == numUint) && fitsUint(l, lk) && fitsUint(r, rk):
+		return arithUint(op, l.Uint(), r.Uint())
+	case fitsInt(l, lk) && fitsInt(r, rk):
+		return arithInt(op, l.Int(), r.Int())
+	}
+	// a negative integer and an unsigned one too large for an int64
+	return arithFloat(op, l.Float(), r.Float())
+}
+
+func fitsUint(v Value, k numKind) bool { return k == numUint || v.Int() >= 0 }
+
+func fitsInt(v Value, k numKind) bool { return k == numInt || v.Uint() <= math.MaxInt64 }
+
+func arithInt(op Token, l, r int64) (Value, error) {
+	switch op {
+	case TokAdd:
+		return intValue(l + r), nil
+	case TokSub:
+		return intValue(l - r), nil
+	case TokMul:
+		return intValue(l * r), nil
+	case TokDiv:
+		if r == 0 {
+			return nil, errDivByZero
+		}
+		return intValue(l / r), nil
+	case TokRem:
+		if r == 0 {
+			return nil, errModByZero
+		}
+		return intValue(l % r), nil
+	}
+	panic("unreachable")
+}
+
+func arithUint(op Token, l, r uint64) (Value, error) {
+	switch op {
+	case TokAdd:
+		return uintValue(l + r), nil
+	case TokSub:
+		if l >= r {
+			return uintValue(l - r), nil
+		}
+		if d := r - l; d <= 1<<63 {
+			return intValue(-int64(d)), nil
+		}
+		return floatValue(float64(l) - float64(r)), nil
+	case TokMul:
+		return uintValue(l * r), nil
+	case TokDiv:
+		if r == 0 {
+			return nil, errDivByZero
+		}
+		return uintValue(l / r), nil
+	case TokRem:
+		if r == 0 {
+			return nil, errModByZero
+		}
+		return uintValue(l % r), nil
+	}
+	panic("unreachable")
+}
+
+func arithFloat(op Token, l, r float64) (Value, error) {
+	switch op {
+	case TokAdd:
+		return floatValue(l + r), nil
+	case TokSub:
+		return floatValue(l - r), nil
+	case TokMul:
+		return floatValue(l * r), nil
+	case TokDiv:
+		if r == 0 {
+			return nil, errDivByZero
+		}
+		return floatValue(l / r), nil
+	case TokRem:
+		if r == 0 {
+			return nil, errModByZero
+		}
+		return floatValue(math.Mod(l, r)), nil
+	}
+	panic("unreachable")
+}
+
+// isString reports whether v is a string rather than a number in
+// arithmetic.
+func isString(v Value) bool {
+	switch v.(type) {
+	case stringValue, SafeString, superValue:
+		return true
+	}
+	return false
+}
+
+// repeatString returns s repeated n times, or an empty string if n is
+// negative. n must be an integer.
+func repeatString(s, n Value) (Value, error) {
+	if isString(n) || numKindOf(n) == numFloat {
+		return nil, fmt.Errorf("can't repeat a string %s times", quoteString(n))
+	}
+	str := s.String()
+	count := 0
+	switch {
+	case numKindOf(n) == numUint && n.Uint() > math.MaxInt32, n.Int() > math.MaxInt32:
+		count = math.MaxInt32
+	case n.Int() > 0:
+		count = int(n.Int())
+	}
+	if count > 0 && len(str) > maxRepeat/count {
+		return nil, fmt.Errorf("repeated string is too long")
+	}
+	return keepSafe(s, strings.Repeat(str, count)), nil
+}
+
+// maxRepeat is the length of the longest string repeatString returns.
+const maxRepeat = 1 << 24
+
+// formatString formats args according to the fmt.Sprintf format f. If args
+// is a slice or array, its elements are the arguments; otherwise args is
+// the only one.
+func formatString(f string, args Value) Value {
+	var a []interface{}
+	if arr, ok := args.(arrayValue); ok {
+		ref := reflect.Value(arr.reflectValue)
+		for i := 0; i < ref.Len(); i++ {
+			a = append(a, formatArg(refToVal(ref.Index(i))))
+		}
+	} else {
+		a = []interface{}{formatArg(args)}
+	}
+	return stringValue(fmt.Sprintf(f, a...))
+}
+
+// formatArg returns the Go value of v for formatting.
+func formatArg(v Value) interface{} {
+	ref := goValue(v)
+	switch {
+	case !ref.IsValid():
+		return nil
+	case !ref.CanInterface():
+		// read from an unexported field
+		return v.String()
+	}
+	return ref.Interface()
+}
+
+// negate returns -v, which is a float if v is one and an integer otherwise.
+func negate(v Value) Value {
+	if numKindOf(v) == numFloat {
+		return floatValue(-v.Float())
+	}
+	// subtraction can't fail and handles unsigned values
+	neg, _ := arith(TokSub, intValue(0), v)
+	return neg
+}
@@ -0,0 +1,84 @@
+package template
+
+import (
+	"bytes"
+	"math"
+	"testing"
+)
+
+var arithTests = []templateTest{
+	{"{{ 1.5 + 1.5 }}", nil, "3"},
+	{"{{ 1.5 + 1 }}", nil, "2.5"},
+	{"{{ 2 * 1.25 }}", nil, "2.5"},
+	{"{{ price * 1.2 }}", c{"price": 10}, "12"},
+	{"{{ price * 2 }}", c{"price": float32(1.5)}, "3"},
+	{"{{ 7 / 2 }}", nil, "3"},
+	{"{{ -7 / 2 }}", nil, "-3"},
+	{"{{ 7 / 2.0 }}", nil, "3.5"},
+	{"{{ 7.5 % 2 }}", nil, "1.5"},
+	{"{{ -7 % 3 }}", nil, "-1"},
+	{"{{ x - 1 }}", c{"x": "1.5"}, "0.5"},
+	{"{{ x / 2 }}", c{"x": "5"}, "2"},
+	{"{{ x + y }}", c{"x": true, "y": nil}, "1"},
+	{"{{ -x }}", c{"x": 1.5}, "-1.5"},
+	{"{{ -x }}", c{"x": uint(3)}, "-3"},
+	{"{{ x }}", c{"x": uint64(math.MaxUint64)}, "18446744073709551615"},
+	{"{{ x - 1 }}", c{"x": uint64(math.MaxUint64)}, "18446744073709551614"},
+	{"{{ x / 5 }}", c{"x": uint64(math.MaxUint64)}, "3689348814741910323"},
+	{"{{ x - 3 }}", c{"x": uint8(1)}, "-2"},
+	{"{{ x + -1 }}", c{"x": uint8(1)}, "0"},
+	{"{{ x + -1 }}", c{"x": uint64(math.MaxUint64)}, "1.8446744073709552e+19"},
+	{"{{ x * 2 }}", c{"x": &[]float64{1.25}[0]}, "2.5"},
+	{"{{ p + 1 }} {{ p * 2 }} {{ -p }} {{ p / 2 }}", c{"p": &[]int{5}[0]}, "6 10 -5 2"},
+	{"{{ p - 6 }} {{ p + q }}", c{"p": &[]uint{5}[0], "q": (*int)(nil)}, "-1 5"},
+	{"{{ 1 + 2 * 3 - 4 / 2 }}", nil, "5"},
+
+	// strings
+	{"{{ 'a' + 'b' }}", nil, "ab"},
+	{"{{ 'a' + 1 }} {{ 1.5 + 'a' }} {{ '1' + '2' }}", nil, "a1 1.5a 12"},
+	{"{{ s + ': ' + n }}", c{"s": "count", "n": uint(3)}, "count: 3"},
+	{"{{ 'ab' * 3 }} {{ 2 * 'ab' }} {{ 'ab' * -1 }}", nil, "ababab abab "},
+	{"{{ '%05.2f' % price }}", c{"price": 3.14159}, "03.14"},
+	{"{{ '%s has %d' % l }}", c{"l": []interface{}{"ann", 2}}, "ann has 2"},
+	{"{{ '%d-%s' % x }}", c{"x": 1}, "1-%!s(MISSING)"},
+	{"{{ '%v' % x }}", c{"x": testStruct{1, 2}}, "{1 2}"},
+}
+
+func TestArith(t *testing.T) {
+	testTemplates(t, arithTests)
+}
+
+func TestStringArith(t *testing.T) {
+	env := NewEnvironment().Option("autoescape=on")
+	testEnv(t, env, []templateTest{
+		{"{{ s + s }}{{ s + '<' }}", c{"s": SafeString("<b>")}, "<b><b>&lt;b&gt;&lt;"},
+		{"{{ s * 2 }}", c{"s": SafeString("<br>")}, "<br><br>"},
+		{"{% block b %}x{% endblock %}{% block c %}{{ block.super + '<' }}{% endblock %}", nil, "x&lt;"},
+	})
+
+	for _, src := range []string{"{{ 'a' * 1.5 }}", "{{ 'a' * 'b' }}", "{{ 'a' * 1000000000 }}"} {
+		if err := MustParseString(src).Execute(&bytes.Buffer{}, nil); err == nil {
+			t.Errorf("%s: got no error", src)
+		}
+	}
+}
+
+func TestDivisionByZero(t *testing.T) {
+	tests := []struct {
+		template string
+		err      string
+	}{
+		{"{{ 12/0 }}", "1:6: division by zero"},
+		{"{{ 12 % 0 }}", "1:7: modulo by zero"},
+		{"{{ 1.5 / x }}", "1:8: division by zero"},
+		{"{{ x % 0.0 }}", "1:6: modulo by zero"},
+		{"{{ u / 0 }}", "1:6: division by zero"},
+	}
+	for i, test := range tests {
+		temp := MustParseString(test.template)
+		err := temp.Execute(&bytes.Buffer{}, c{"x": 0, "u": uint(1)})
+		if err == nil || err.Error() != test.err {
+			t.Errorf("#%d got error %v want %s", i, err, test.err)
+		}
+	}
+}
@@ -0,0 +1,185 @@
+package template
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+)
+
+// ParseTyped is like Parse, but also checks the template against typ, the
+// type of the data it will be executed with. See Environment.ParseTyped.
+func ParseTyped(s []byte, typ reflect.Type) (*Template, error) {
+	return defaultEnv.ParseTyped(s, typ)
+}
+
+// ParseTyped is like Parse, but also checks the template against typ, the
+// type of the data it will be executed with. Each variable the template
+// reads must be a field of typ, or typ must be a map with string keys.
+// Attributes are checked the same way against the types of the fields they
+// are read from, following the rules used when the template is executed,
+// and the collections of for tags must be something that can be looped
+// over. Where a type can't be known before execution, such as that of a
+// field of interface type or the result of a filter, checking stops.
+// Problems are reported as parse errors.
+func (e *Environment) ParseTyped(s []byte, typ reflect.Type) (*Template, error) {
+	return e.parseTyped("", s, typ)
+}
+
+// errorAt is like Error, but reports the error at pos instead of at the
+// current token.
+func (p *Parser) errorAt(pos Position, format string, args ...interface{}) {
+	panic(&ParseError{
+		Position: pos,
+		Tok:      p.tok,
+		Lit:      string(p.lit),
+		Msg:      fmt.Sprintf(format, args...),
+		Excerpt:  excerpt(p.l.src, pos.Offset),
+	})
+}
+
+// setType records the static type of v, which must be in the innermost
+// level of the Scope, for checking expressions that use it.
+func (p *Parser) setType(v Variable, t reflect.Type) {
+	if p.typ == nil {
+		return
+	}
+	level := p.s.levels[len(p.s.levels)-1]
+	if level.types == nil {
+		level.types = make(map[Variable]reflect.Type)
+	}
+	level.types[v] = t
+}
+
+// typeOf returns the static type of e, or nil if it can't be known before
+// the template is executed. It reports an error if e reads an attribute
+// that can't exist.
+func (p *Parser) typeOf(e Expr) reflect.Type {
+	if p.typ == nil {
+		return nil
+	}
+	switch e := e.(type) {
+	case *varExpr:
+		if p.s.isFree(e.name, e.v) {
+			return p.attrType(p.typ, e.name, e.pos)
+		}
+		for i := len(p.s.levels) - 1; i >= 0; i-- {
+			if t, ok := p.s.levels[i].types[e.v]; ok {
+				return t
+			}
+		}
+	case *attrExpr:
+		if t := p.typeOf(e.x); t != nil {
+			return p.attrType(t, e.attr, e.pos)
+		}
+	case *indexExpr:
+		if t := p.typeOf(e.x); t != nil {
+			return elemType(t)
+		}
+	case *sliceExpr:
+		if t := p.typeOf(e.x); t != nil {
+			for t.Kind() == reflect.Ptr {
+				t = t.Elem()
+			}
+			switch t.Kind() {
+			case reflect.Array:
+				return reflect.SliceOf(t.Elem())
+			case reflect.Slice, reflect.String:
+				return t
+			}
+		}
+	case constExpr:
+		if ref := goValue(e.v); ref.IsValid() {
+			return ref.Type()
+		}
+	}
+	return nil
+}
+
+// attrType returns the type of the attribute name of a value of type t,
+// reporting an error at pos if there can be no such attribute.
+func (p *Parser) attrType(t reflect.Type, name string, pos Position) reflect.Type {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	_, err := strconv.Atoi(name)
+	isIndex := err == nil
+	switch t.Kind() {
+	case reflect.Interface:
+		return nil
+	case reflect.Struct:
+		if f, ok := t.FieldByName(name); ok {
+			return f.Type
+		}
+	case reflect.Map:
+		switch t.Key().Kind() {
+		case reflect.String:
+			return t.Elem()
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+			reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+			if isIndex {
+				return t.Elem()
+			}
+		default:
+			return nil
+		}
+	case reflect.Array, reflect.Slice:
+		if isIndex {
+			return t.Elem()
+		}
+	case reflect.String:
+		if isIndex {
+			return reflect.TypeOf("")
+		}
+	}
+	// the method set of the pointer type includes that of t
+	if m, ok := reflect.PtrTo(t).MethodByName(name); ok && isGetter(m.Type, 1) {
+		return m.Type.Out(0)
+	}
+	p.errorAt(pos, "%s has no field %s", typeName(t), name)
+	return nil
+}
+
+// elemType returns the type of the elements of a value of type t read by
+// subscripts, or nil if it isn't known.
+func elemType(t reflect.Type) reflect.Type {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch t.Kind() {
+	case reflect.Array, reflect.Slice, reflect.Map:
+		return t.Elem()
+	case reflect.String:
+		return reflect.TypeOf("")
+	}
+	return nil
+}
+
+// rangeType returns the type of the loop variable of a for tag whose
+// collection has type t, reporting an error at pos if t can't be looped
+// over.
+func (p *Parser) rangeType(t reflect.Type, pos Position) reflect.Type {
+	if t == nil {
+		return nil
+	}
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch t.Kind() {
+	case reflect.Array, reflect.Slice, reflect.Chan, reflect.Map:
+		return t.Elem()
+	case reflect.String:
+		return t
+	case reflect.Interface, reflect.Struct:
+		return nil
+	}
+	p.errorAt(pos, "can't loop over %s", typeName(t))
+	return nil
+}
+
+// typeName returns the name of t without its package, as in "Page".
+func typeName(t reflect.Type) string {
+	if t.Name() != "" {
+		return t.Name()
+	}
+	return t.String()
+}
@@ -0,0 +1,67 @@
+package template
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+type page struct {
+	Title  string
+	Author *user
+	Tags   []string
+	Meta   map[string]int
+	Extra  interface{}
+	Count  int
+	ByID   map[int]user
+	Groups [][]user
+}
+
+var typedTests = []parseErrorTest{
+	{"{{ Title }}{{ Author.Name }}{{ Tags.0 }}{{ Meta.anything }}{{ Extra.x.y }}{{ ByID.3 }}", 0, 0, ""},
+	{"{% for t in Tags %}{{ t.0 }}{% endfor %}{% for g in Groups %}{% for u in g %}{{ u.Friends.0 }}{% endfor %}{% endfor %}", 0, 0, ""},
+	{"{% set a Author %}{{ a.Name }}{% for x in Extra %}{{ x.y }}{% endfor %}{{ Title|lower }}", 0, 0, ""},
+	{"{{ Author.Greeting.0 }}{{ Author.Count }}{% for f in Author.Best %}{% endfor %}", 0, 0, ""},
+	{"{{ Author.Add }}", 1, 11, "user has no field Add"},
+	{"{{ Groups[0][Count].Name }}{{ Meta[Title] }}{% for t in Tags[1:] %}{{ t[0] }}{% endfor %}", 0, 0, ""},
+	{"{{ Groups[0][1].Nmae }}", 1, 17, "user has no field Nmae"},
+	{"{% for t in Tags[:2] %}{{ t.x }}{% endfor %}", 1, 29, "string has no field x"},
+	{"{{ Titel }}", 1, 4, "page has no field Titel"},
+	{"{{ Author.Nmae }}", 1, 11, "user has no field Nmae"},
+	{"{{ Tags.first }}", 1, 9, "[]string has no field first"},
+	{"{{ Count.x }}", 1, 10, "int has no field x"},
+	{"{{ ByID.x }}", 1, 9, "map[int]template.user has no field x"},
+	{"{{ Title|default:Titel }}", 1, 18, "page has no field Titel"},
+	{"{% for x in Count %}{% endfor %}", 1, 13, "can't loop over int"},
+	{"{% for u in Groups %}{% for x in u %}{{ x.Name }}{{ x.Age }}{% endfor %}{% endfor %}", 1, 55, "user has no field Age"},
+	{"{% set a Author %}{{ a.Nmae }}", 1, 24, "user has no field Nmae"},
+	{"{{ 'abc'.x }}", 1, 10, "string has no field x"},
+}
+
+func TestParseTyped(t *testing.T) {
+	for _, typ := range []reflect.Type{reflect.TypeOf(page{}), reflect.TypeOf(&page{})} {
+		for i, test := range typedTests {
+			_, err := ParseTyped([]byte(test.template), typ)
+			if test.msg == "" {
+				if err != nil {
+					t.Errorf("#%d got error %v", i, err)
+				}
+				continue
+			}
+			var perr *ParseError
+			if !errors.As(err, &perr) {
+				t.Errorf("#%d got error %v, want a *ParseError", i, err)
+				continue
+			}
+			if perr.Line != test.line || perr.Column != test.column || perr.Msg != test.msg {
+				t.Errorf("#%d got %d:%d: %s want %d:%d: %s", i, perr.Line, perr.Column, perr.Msg,
+					test.line, test.column, test.msg)
+			}
+		}
+	}
+
+	// maps with string keys allow any variable
+	if _, err := ParseTyped([]byte("{{ anything.at.all }}"), reflect.TypeOf(c{})); err != nil {
+		t.Errorf("got error %v", err)
+	}
+}
@@ -0,0 +1,325 @@
+package template
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"strings"
+	"time"
+)
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// A cmpKind is the kind of a Value in comparisons. Values of different
+// kinds are never equal and can't be ordered.
+type cmpKind uint8
+
+const (
+	cmpNil cmpKind = iota
+	cmpBool
+	cmpNumber
+	cmpString
+	cmpTime
+	cmpOther // compared deeply for equality, and not ordered
+)
+
+// cmpKindOf returns the kind of v in comparisons, following pointers, and
+// the value compared, which is that of the pointer's element.
+func cmpKindOf(v Value) (Value, cmpKind) {
+	switch val := v.(type) {
+	case nilValue:
+		return v, cmpNil
+	case boolValue:
+		return v, cmpBool
+	case intValue, uintValue, floatValue:
+		return v, cmpNumber
+	case stringValue, SafeString, superValue:
+		return v, cmpString
+	case pointerValue:
+		if val.isNil() {
+			return v, cmpNil
+		}
+		return cmpKindOf(val.value())
+	}
+	ref := goValue(v)
+	switch {
+	case !ref.IsValid():
+		return v, cmpNil
+	case ref.Type() == timeType && ref.CanInterface():
+		return v, cmpTime
+	}
+	return v, cmpOther
+}
+
+// compare applies the comparison operator op to l and r. Numbers compare
+// by value whatever their types, strings lexically and times
+// chronologically. Other values are equal if they're deeply equal. Values
+// that can't be ordered, such as a number and a string, are an error for
+// the ordering operators. The exception is nil, which like an undefined
+// value in Django is neither less nor greater than anything, unless strict
+// is set.
+func compare(op Token, l, r Value, strict bool) (bool, error) {
+	switch op {
+	case TokEqual:
+		return equal(l, r), nil
+	case TokNotEq:
+		return !equal(l, r), nil
+	}
+	if !strict {
+		_, lk := cmpKindOf(l)
+		_, rk := cmpKindOf(r)
+		if lk == cmpNil || rk == cmpNil {
+			return false, nil
+		}
+	}
+	c, err := order(l, r)
+	if err != nil {
+		return false, err
+	}
+	switch op {
+	case TokLess:
+		return c < 0, nil
+	case TokLessEq:
+		return c <= 0, nil
+	case TokGreater:
+		return c > 0, nil
+	case TokGreaterEq:
+		return c >= 0, nil
+	}
+	panic("unreachable")
+}
+
+// equal reports whether l and r are equal, as described by compare.
+func equal(l, r Value) bool {
+	l, lk := cmpKindOf(l)
+	r, rk := cmpKindOf(r)
+	if lk != rk {
+		return false
+	}
+	switch lk {
+	case cmpNil:
+		return true
+	case cmpBool:
+		return l.Bool() == r.Bool()
+	case cmpNumber:
+		if numKindOf(l) == numFloat || numKindOf(r) == numFloat {
+			return l.Float() == r.Float()
+		}
+		return orderInts(l, r) == 0
+	case cmpString:
+		return l.String() == r.String()
+	case cmpTime:
+		return timeOf(l).Equal(timeOf(r))
+	}
+	return deepEqual(goValue(l), goValue(r), make(map[visit]bool))
+}
+
+// order returns -1, 0 or 1 as l is less than, equal to or greater than r,
+// or an error if they can't be ordered.
+func order(l, r Value) (int, error) {
+	l, lk := cmpKindOf(l)
+	r, rk := cmpKindOf(r)
+	if lk != rk || lk == cmpNil || lk == cmpOther {
+		return 0, fmt.Errorf("can't compare %s and %s", cmpTypeName(l), cmpTypeName(r))
+	}
+	switch lk {
+	case cmpBool:
+		return orderInts(l, r), nil
+	case cmpNumber:
+		if numKindOf(l) != numFloat && numKindOf(r) != numFloat {
+			return orderInts(l, r), nil
+		}
+		a, b := l.Float(), r.Float()
+		switch {
+		case math.IsNaN(a) || math.IsNaN(b):
+			return 0, fmt.Errorf("can't compare NaN")
+		case a < b:
+			return -1, nil
+		case a > b:
+			return 1, nil
+		}
+		return 0, nil
+	case cmpString:
+		return strings.Compare(l.String(), r.String()), nil
+	}
+	return timeOf(l).Compare(timeOf(r)), nil
+}
+
+// contains reports whether the collection coll contains v, as tested by
+// the in operator. A string contains its substrings, a slice or array its
+// elements and a map its keys, compared as by equal. Nothing is in nil.
+func contains(coll, v Value) (bool, error) {
+	coll, kind := cmpKindOf(coll)
+	switch kind {
+	case cmpNil:
+		return false, nil
+	case cmpString:
+		if _, k := cmpKindOf(v); k != cmpString {
+			return false, fmt.Errorf("can't look for %s in string", cmpTypeName(v))
+		}
+		return strings.Contains(coll.String(), v.String()), nil
+	}
+	ref := reflect.Indirect(goValue(coll))
+	switch ref.Kind() {
+	case reflect.Array, reflect.Slice:
+		for i := 0; i < ref.Len(); i++ {
+			if equal(refToVal(ref.Index(i)), v) {
+				return true, nil
+			}
+		}
+		return false, nil
+	case reflect.Map:
+		return mapKey(ref, v).IsValid(), nil
+	}
+	return false, fmt.Errorf("can't look for %s in %s", cmpTypeName(v), cmpTypeName(coll))
+}
+
+// mapKey returns the key of the map m that's equal to key, or the zero
+// Value if there's none.
+func mapKey(m reflect.Value, key Value) reflect.Value {
+	kt := m.Type().Key()
+	if k := goValue(key); k.IsValid() && k.CanInterface() && k.Type().AssignableTo(kt) {
+		if m.MapIndex(k).IsValid() {
+			return k
+		}
+		if k.Type() == kt {
+			// no other key can be equal
+			return reflect.Value{}
+		}
+	}
+	basic := kt.Kind() <= reflect.Complex128 || kt.Kind() == reflect.String
+	if k := goValue(key); basic && k.IsValid() && k.CanInterface() && k.Type().ConvertibleTo(kt) {
+		// the conversion must not change the key, as from 1.5 to 1, and
+		// then no other key can be equal
+		if ck := k.Convert(kt); equal(refToVal(ck), key) {
+			if m.MapIndex(ck).IsValid() {
+				return ck
+			}
+			return reflect.Value{}
+		}
+	}
+	for _, k := range m.MapKeys() {
+		if equal(refToVal(k), key) {
+			return k
+		}
+	}
+	return reflect.Value{}
+}
+
+// orderInts orders l and r, which are signed or unsigned integers or bools.
+func orderInts(l, r Value) int {
+	lu, ru := numKindOf(l) == numUint, numKindOf(r) == numUint
+	switch {
+	case lu && !ru && r.Int() < 0:
+		return 1
+	case ru && !lu && l.Int() < 0:
+		return -1
+	case lu || ru:
+		a, b := l.Uint(), r.Uint()
+		if a < b {
+			return -1
+		} else if a > b {
+			return 1
+		}
+		return 0
+	}
+	a, b := l.Int(), r.Int()
+	if a < b {
+		return -1
+	} else if a > b {
+		return 1
+	}
+	return 0
+}
+
+func timeOf(v Value) time.Time {
+	return goValue(v).Interface().(time.Time)
+}
+
+// cmpTypeName returns the name of the type of v for errors.
+func cmpTypeName(v Value) string {
+	ref := goValue(v)
+	if !ref.IsValid() {
+		return "nil"
+	}
+	return typeName(ref.Type())
+}
+
+// A visit is a pair of values being compared by deepEqual, identified by
+// their addresses, that's already been seen.
+type visit struct {
+	a, b uintptr
+	typ  reflect.Type
+}
+
+// deepEqual is like reflect.DeepEqual, but works for values read from
+// unexported fields, which can't be turned back into interfaces.
+func deepEqual(a, b reflect.Value, seen map[visit]bool) bool {
+	if !a.IsValid() || !b.IsValid() {
+		return a.IsValid() == b.IsValid()
+	}
+	if a.Type() != b.Type() {
+		return false
+	}
+	if a.CanInterface() && b.CanInterface() {
+		return reflect.DeepEqual(a.Interface(), b.Interface())
+	}
+	switch a.Kind() {
+	case reflect.Ptr, reflect.Map, reflect.Slice:
+		if a.IsNil() || b.IsNil() {
+			return a.IsNil() == b.IsNil()
+		}
+		v := visit{a.Pointer(), b.Pointer(), a.Type()}
+		if seen[v] {
+			return true
+		}
+		seen[v] = true
+	}
+	switch a.Kind() {
+	case reflect.Bool:
+		return a.Bool() == b.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return a.Int() == b.Int()
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return a.Uint() == b.Uint()
+	case reflect.Float32, reflect.Float64:
+		return a.Float() == b.Float()
+	case reflect.Complex64, reflect.Complex128:
+		return a.Complex() == b.Complex()
+	case reflect.String:
+		return a.String() == b.String()
+	case reflect.Ptr, reflect.Interface:
+		return deepEqual(a.Elem(), b.Elem(), seen)
+	case reflect.Array, reflect.Slice:
+		if a.Len() != b.Len() {
+			return false
+		}
+		for i := 0; i < a.Len(); i++ {
+			if !deepEqual(a.Index(i), b.Index(i), seen) {
+				return false
+			}
+		}
+		return true
+	case reflect.Map:
+		if a.Len() != b.Len() {
+			return false
+		}
+		for _, k := range a.MapKeys() {
+			if !deepEqual(a.MapIndex(k), b.MapIndex(k), seen) {
+				return false
+			}
+		}
+		return true
+	case reflect.Struct:
+		for i := 0; i < a.NumField(); i++ {
+			if !deepEqual(a.Field(i), b.Field(i), seen) {
+				return false
+			}
+		}
+		return true
+	case reflect.Chan, reflect.UnsafePointer:
+		return a.Pointer() == b.Pointer()
+	}
+	// functions, like in reflect.DeepEqual, are only equal if both are nil
+	return a.IsNil() && b.IsNil()
+}
@@ -0,0 +1,85 @@
+package template
+
+import (
+	"bytes"
+	"math"
+	"testing"
+	"time"
+)
+
+var (
+	day1 = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	day2 = time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)
+)
+
+var compareTests = []templateTest{
+	// numbers of any type
+	{"{{ 1 == 1.0 }} {{ 1 != 1.0 }} {{ 1.5 > 1 }} {{ 2 < 1.5 }}", nil, "true false true false"},
+	{"{{ x == 3 }} {{ x > -1 }} {{ -1 < x }} {{ x >= y }}", c{"x": uint(3), "y": int8(3)}, "true true true true"},
+	{"{{ x > 1 }}", c{"x": uint64(math.MaxUint64)}, "true"},
+	{"{{ x == 1.25 }}", c{"x": &[]float32{1.25}[0]}, "true"},
+	// strings
+	{"{{ 'b' > 'a' }} {{ 'ab' < 'b' }} {{ '10' < '9' }} {{ x == 'a' }}", c{"x": SafeString("a")}, "true true true true"},
+	{"{{ '1' == 1 }} {{ '1' != 1 }}", nil, "false true"},
+	// times
+	{"{{ a < b }} {{ a == a }} {{ a >= b }}", c{"a": day1, "b": &day2}, "true true false"},
+	{"{{ a == b }}", c{"a": day1, "b": day1.In(time.FixedZone("x", 3600))}, "true"},
+	// other values
+	{"{{ a == b }} {{ a == c }} {{ a != c }}", c{"a": []int{1, 2}, "b": []int{1, 2}, "c": []int{1}}, "true false true"},
+	{"{{ a == b }}", c{"a": map[string]int{"x": 1}, "b": map[string]int{"x": 1}}, "true"},
+	{"{{ a.a == b.a }} {{ a == b }}", c{"a": testStruct{1, 2}, "b": &testStruct{1, 3}}, "true false"},
+	{"{{ a == b }} {{ a == 0 }} {{ true == 1 }}", nil, "true false false"},
+	// nil isn't ordered, but that isn't an error by default
+	{"{{ x >= 1 }} {{ x < 1 }} {{ 1 > p }} {% if count > 0 %}yes{% endif %}", c{"p": (*int)(nil)}, "false false false "},
+	// ifchanged compares the same way
+	{"{% for x in l %}{% ifchanged x %}{{ x.0 }}{% endifchanged %}{% endfor %}", c{"l": [][]int{{1}, {1}, {2}, {1}}}, "121"},
+	{"{% for x in l %}{% ifchanged x %}{{ x }}{% endifchanged %}{% endfor %}", c{"l": []interface{}{1, 1.0, "1", nil, nil}}, "11"},
+}
+
+var inTests = []templateTest{
+	{"{{ 'b' in 'abc' }} {{ 'x' in 'abc' }} {{ 'x' not in 'abc' }} {{ '' in '' }}", nil, "true false true true"},
+	{"{{ u in admins }} {{ 'cy' in admins }} {{ u not in admins }}", c{"u": "bob", "admins": []string{"ann", "bob"}}, "true false false"},
+	{"{{ 1 in l }} {{ 2.0 in l }} {{ '1' in l }} {{ l in ll }}", c{"l": [2]uint{1, 2}, "ll": [][2]uint{{1, 2}}}, "true true false true"},
+	{"{{ 'a' in m }} {{ 'b' in m }} {{ 1 in n }}", c{"m": map[string]int{"a": 0}, "n": map[int8]bool{1: false}}, "true false true"},
+	{"{{ 'a' in m }} {{ 'a' not in m }}", c{"m": &map[key]int{"a": 1}}, "true false"},
+	{"{{ 'a' in missing }} {{ 'a' not in missing }}", nil, "false true"},
+	// precedence and neighbouring words
+	{"{{ 1 + 1 in l and 3 not in l }}", c{"l": []int{2}}, "true"},
+	{"{{ not x in l }} {{ not x not in l }} {{ not x == 3 }} {{ not x > 5 and x }}", c{"x": 3, "l": []int{1}}, "true false false true"},
+	{"{{ not not x in l or 1 }} {{ 1 + not x }}", c{"x": 3, "l": []int{1}}, "true 1"},
+	{"{{ not in_stock }}{{ not\tin_stock }}", c{"in_stock": false}, "truetrue"},
+	{"{% if x not\n in l %}yes{% endif %}{% for in_ in l %}{{ in_ }}{% endfor %}", c{"x": 3, "l": []int{1}}, "yes1"},
+}
+
+func TestCompare(t *testing.T) {
+	testTemplates(t, compareTests)
+	testTemplates(t, inTests)
+}
+
+func TestCompareErrors(t *testing.T) {
+	tests := []struct {
+		template string
+		err      string
+	}{
+		{"{{ 'a' < 1 }}", "1:8: can't compare string and int64"},
+		{"{{ l > l }}", "1:6: can't compare []int and []int"},
+		{"{{ t <= 1 }}", "1:6: can't compare Time and int64"},
+		{"{{ 1 in 'a1' }}", "1:6: can't look for int64 in string"},
+		{"{{ 1 not in t }}", "1:6: can't look for int64 in Time"},
+		{"{{ 1 in 2 }}", "1:6: can't look for int64 in int64"},
+	}
+	for i, test := range tests {
+		temp := MustParseString(test.template)
+		err := temp.Execute(&bytes.Buffer{}, c{"l": []int{1}, "t": day1})
+		if err == nil || err.Error() != test.err {
+			t.Errorf("#%d got error %v want %s", i, err, test.err)
+		}
+	}
+
+	// with undefined=error, ordering nil is an error
+	temp := MustParseString("{{ x >= 1 }}")
+	err := temp.ExecuteOptions(&bytes.Buffer{}, c{"x": nil}, "undefined=error")
+	if want := "1:6: can't compare nil and int64"; err == nil || err.Error() != want {
+		t.Errorf("got error %v want %s", err, want)
+	}
+}
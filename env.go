@@ -0,0 +1,252 @@
+package template
+
+import (
+	"io/ioutil"
+	"sync"
+)
+
+// An Environment holds the tags, filters and options that templates are
+// parsed with, and the Loader that finds templates by name. Each template is
+// bound to the Environment that parsed it, so Environments with different
+// vocabularies can be used side by side.
+//
+// The package-level functions such as Parse and RegisterTag use a default
+// Environment.
+type Environment struct {
+	mu      sync.Mutex
+	tags    map[string]TagFunc
+	filters map[string]*regFilter
+	opts    options
+	loader  Loader
+
+	// cache holds the templates loaded by name
+	cache map[string]*cacheEntry
+}
+
+// A cacheEntry holds a template that's loaded or being loaded.
+type cacheEntry struct {
+	done chan struct{} // closed once t and err are set
+	t    *Template
+	err  error
+}
+
+var defaultEnv = NewEnvironment()
+
+// NewEnvironment returns an Environment with the built-in tags and filters
+// and the default options.
+func NewEnvironment() *Environment {
+	// The maps are never modified once they're in use; registering a tag or
+	// filter replaces them. That makes them safe to share.
+	return &Environment{tags: builtinTags, filters: builtinFilters}
+}
+
+// snapshot returns the tags, filters and options to parse a template with.
+func (e *Environment) snapshot() (map[string]TagFunc, map[string]*regFilter, options) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.tags, e.filters, e.opts
+}
+
+// Option sets the options that templates parsed by the Environment start
+// with. See Template.Option for the options available.
+func (e *Environment) Option(opt ...string) *Environment {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for _, o := range opt {
+		e.opts.set(o)
+	}
+	return e
+}
+
+// SetLoader sets the Loader used to find templates by name and empties the
+// cache of loaded templates. Without a Loader, names are treated as file
+// names relative to the working directory.
+func (e *Environment) SetLoader(l Loader) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.loader = l
+	e.cache = nil
+}
+
+// Load returns the template with the given name from the Environment's
+// Loader. Templates are loaded once and cached; failures aren't cached, so
+// a template that failed to load is tried again the next time. If the
+// Loader is a Reloader in reload mode, a cached template whose source has
+// changed is loaded again; should that fail, the error is returned and the
+// previous version stays cached.
+// Load is safe to call from multiple goroutines.
+func (e *Environment) Load(name string) (*Template, error) {
+	t, _, err := e.load(name, true)
+	return t, err
+}
+
+// load returns the template with the given name, loading it if it isn't
+// cached. If the template is being loaded by another call and wait is false,
+// load returns ok == false instead of waiting for it. This lets the parser
+// resolve includes eagerly without deadlocking on templates that include
+// themselves.
+func (e *Environment) load(name string, wait bool) (t *Template, ok bool, err error) {
+	e.mu.Lock()
+	l := e.loader
+	if ent, found := e.cache[name]; found {
+		e.mu.Unlock()
+		if !wait {
+			select {
+			case <-ent.done:
+			default:
+				return nil, false, nil
+			}
+		}
+		<-ent.done
+		if r, ok := l.(Reloader); ok && ent.err == nil && r.Reloading() && r.Changed(name, ent.t) {
+			t, err := e.reload(name, ent, r)
+			return t, true, err
+		}
+		return ent.t, true, ent.err
+	}
+	ent := &cacheEntry{done: make(chan struct{})}
+	if e.cache == nil {
+		e.cache = make(map[string]*cacheEntry)
+	}
+	e.cache[name] = ent
+	e.mu.Unlock()
+
+	if l == nil {
+		ent.t, ent.err = e.ParseFile(name)
+	} else {
+		ent.t, ent.err = loadWith(l, e, name)
+	}
+	if ent.err != nil {
+		e.mu.Lock()
+		if e.cache[name] == ent {
+			delete(e.cache, name)
+		}
+		e.mu.Unlock()
+	}
+	close(ent.done)
+	return ent.t, true, ent.err
+}
+
+// reload loads a changed template again and replaces old in the cache with
+// it. If loading fails, old stays in the cache.
+func (e *Environment) reload(name string, old *cacheEntry, l Loader) (*Template, error) {
+	t, err := loadWith(l, e, name)
+	if err != nil {
+		return nil, err
+	}
+	ent := &cacheEntry{done: make(chan struct{}), t: t}
+	close(ent.done)
+	e.mu.Lock()
+	if e.cache[name] == old {
+		e.cache[name] = ent
+	}
+	e.mu.Unlock()
+	return t, nil
+}
+
+// reloading reports whether the Environment's Loader is in reload mode, in
+// which case templates resolved while parsing mustn't be reused.
+func (e *Environment) reloading() bool {
+	e.mu.Lock()
+	l := e.loader
+	e.mu.Unlock()
+	r, ok := l.(Reloader)
+	return ok && r.Reloading()
+}
+
+// RegisterTag makes a tag available to templates parsed by the Environment
+// after it returns. If RegisterTag is called twice with the same name or if
+// fn is nil, it panics.
+func (e *Environment) RegisterTag(name string, fn TagFunc) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if fn == nil {
+		panic("template: RegisterTag tag function is nil")
+	}
+	if _, dup := e.tags[name]; dup {
+		panic("template: RegisterTag called twice for tag " + name)
+	}
+	m := make(map[string]TagFunc, len(e.tags)+1)
+	for k, v := range e.tags {
+		m[k] = v
+	}
+	m[name] = fn
+	e.tags = m
+}
+
+// RegisterFilter makes a filter available to templates parsed by the
+// Environment after it returns. arg says whether the filter takes an
+// argument. If RegisterFilter is called twice with the same name or if fn is
+// nil, it panics.
+func (e *Environment) RegisterFilter(name string, fn FilterFunc, arg ArgType) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if fn == nil {
+		panic("template: RegisterFilter filter function is nil")
+	}
+	if _, dup := e.filters[name]; dup {
+		panic("template: RegisterFilter called twice for filter " + name)
+	}
+	m := make(map[string]*regFilter, len(e.filters)+1)
+	for k, v := range e.filters {
+		m[k] = v
+	}
+	m[name] = &regFilter{fn, arg}
+	e.filters = m
+}
+
+// RegisterFilterFunc registers an ordinary Go function as a filter, using
+// AdaptFilter to convert it. It panics if fn can't be adapted or if a filter
+// with the same name is already registered.
+func (e *Environment) RegisterFilterFunc(name string, fn interface{}) {
+	f, arg, err := AdaptFilter(fn)
+	if err != nil {
+		panic(err)
+	}
+	e.RegisterFilter(name, f, arg)
+}
+
+// Parse parses a template from s. If the template is malformed, the
+// returned error is an ErrorList describing every problem found.
+func (e *Environment) Parse(s []byte) (*Template, error) {
+	return e.parse("", s)
+}
+
+// ParseString is like Parse but takes a string.
+func (e *Environment) ParseString(s string) (*Template, error) {
+	return e.parse("", []byte(s))
+}
+
+// ParseFile parses the named file. The file name becomes the template's
+// name.
+func (e *Environment) ParseFile(name string) (*Template, error) {
+	b, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	return e.parse(name, b)
+}
+
+// RegisterTag makes a tag available to templates parsed by the default
+// Environment after it returns. It's intended to be called from init
+// functions. If RegisterTag is called twice with the same name or if fn is
+// nil, it panics.
+func RegisterTag(name string, fn TagFunc) {
+	defaultEnv.RegisterTag(name, fn)
+}
+
+// RegisterFilter makes a filter available to templates parsed by the default
+// Environment after it returns. arg says whether the filter takes an
+// argument. It's intended to be called from init functions. If
+// RegisterFilter is called twice with the same name or if fn is nil, it
+// panics.
+func RegisterFilter(name string, fn FilterFunc, arg ArgType) {
+	defaultEnv.RegisterFilter(name, fn, arg)
+}
+
+// RegisterFilterFunc registers an ordinary Go function as a filter in the
+// default Environment, using AdaptFilter to convert it. It panics if fn
+// can't be adapted or if a filter with the same name is already registered.
+func RegisterFilterFunc(name string, fn interface{}) {
+	defaultEnv.RegisterFilterFunc(name, fn)
+}
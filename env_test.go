@@ -0,0 +1,58 @@
+package template
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestEnvironmentIsolation(t *testing.T) {
+	email := NewEnvironment()
+	email.RegisterFilterFunc("shout", strings.ToUpper)
+	html := NewEnvironment()
+	html.RegisterFilterFunc("shout", func(s string) string { return "<b>" + s + "</b>" })
+
+	for _, test := range []struct {
+		env *Environment
+		out string
+	}{
+		{email, "HI HI"},
+		{html, "<b>hi</b> <b>hi</b>"},
+	} {
+		temp, err := test.env.ParseString("{{ name|shout }} {% include 'testdata/shout' %}")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if temp.Environment() != test.env {
+			t.Error("template isn't bound to its Environment")
+		}
+		var buf bytes.Buffer
+		if err := temp.Execute(&buf, c{"name": "hi"}); err != nil {
+			t.Fatal(err)
+		}
+		if buf.String() != test.out {
+			t.Errorf("got %q want %q", buf.String(), test.out)
+		}
+	}
+
+	if _, err := ParseString("{{ name|shout }}"); err == nil {
+		t.Error("filter registered in an Environment leaked into the default Environment")
+	}
+}
+
+func TestEnvironmentOption(t *testing.T) {
+	env := NewEnvironment().Option("include=ignore")
+	temp, err := env.ParseString("a{% include 'testdata/nosuchfile' %}b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := temp.Execute(&buf, nil); err != nil || buf.String() != "ab" {
+		t.Errorf("got %q, %v", buf.String(), err)
+	}
+	// options can still be changed per template
+	buf.Reset()
+	if err := temp.Option("include=error").Execute(&buf, nil); err == nil {
+		t.Error("expected an error")
+	}
+}
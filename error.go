@@ -0,0 +1,137 @@
+package template
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"unicode/utf8"
+)
+
+// A Position describes a location in a template's source.
+type Position struct {
+	Name   string // name of the template, if any
+	Offset int    // byte offset, starting at 0
+	Line   int    // line number, starting at 1
+	Column int    // column number in characters, starting at 1
+}
+
+// String returns the position in the form "name:line:column", or
+// "line:column" if the template has no name.
+func (pos Position) String() string {
+	s := strconv.Itoa(pos.Line) + ":" + strconv.Itoa(pos.Column)
+	if pos.Name != "" {
+		s = pos.Name + ":" + s
+	}
+	return s
+}
+
+// position returns the Position of the byte at offset off within src.
+func position(name string, src []byte, off int) Position {
+	if off > len(src) {
+		off = len(src)
+	}
+	line := 1 + bytes.Count(src[:off], []byte{'\n'})
+	start := bytes.LastIndex(src[:off], []byte{'\n'}) + 1
+	col := 1 + utf8.RuneCount(src[start:off])
+	return Position{name, off, line, col}
+}
+
+// excerpt returns the source line containing offset off followed by a line
+// with a caret pointing at the offset.
+func excerpt(src []byte, off int) string {
+	if off > len(src) {
+		off = len(src)
+	}
+	start := bytes.LastIndex(src[:off], []byte{'\n'}) + 1
+	end := bytes.IndexByte(src[off:], '\n')
+	if end < 0 {
+		end = len(src)
+	} else {
+		end += off
+	}
+	line := src[start:end]
+	// keep tabs so that the caret lines up with the source line
+	caret := make([]byte, 0, off-start+1)
+	for _, ch := range string(src[start:off]) {
+		if ch == '\t' {
+			caret = append(caret, '\t')
+		} else {
+			caret = append(caret, ' ')
+		}
+	}
+	caret = append(caret, '^')
+	return string(line) + "\n" + string(caret)
+}
+
+// A ParseError describes a problem found while parsing a template.
+type ParseError struct {
+	Position        // position of the offending token
+	Tok      Token  // the offending token
+	Lit      string // literal text of the offending token
+	Msg      string // description of the problem
+	// Excerpt is the source line containing the error followed by a line
+	// with a caret marking the offending token.
+	Excerpt string
+}
+
+func (e *ParseError) Error() string {
+	return e.Position.String() + ": " + e.Msg
+}
+
+// An ErrorList is a list of *ParseErrors in the order they were found.
+// Callers interested in a single error can use the first element.
+type ErrorList []*ParseError
+
+func (l ErrorList) Error() string {
+	switch len(l) {
+	case 0:
+		return "no errors"
+	case 1:
+		return l[0].Error()
+	}
+	return fmt.Sprintf("%s (and %d more errors)", l[0], len(l)-1)
+}
+
+// Unwrap returns the errors in the list, which allows errors.As to find
+// the first *ParseError.
+func (l ErrorList) Unwrap() []error {
+	errs := make([]error, len(l))
+	for i, err := range l {
+		errs[i] = err
+	}
+	return errs
+}
+
+// An ExecError describes a failure while executing a template.
+type ExecError struct {
+	Position       // position of the tag or expression that failed
+	Err      error // the underlying error
+}
+
+func (e *ExecError) Error() string {
+	return e.Position.String() + ": " + e.Err.Error()
+}
+
+func (e *ExecError) Unwrap() error {
+	return e.Err
+}
+
+// Errorf stops execution of the template with an *ExecError whose message is
+// formatted from format and args. It's meant for FilterFuncs and Exprs, which
+// can't return errors; the error is reported at the position of the filter
+// that was running.
+func (c *Context) Errorf(format string, args ...interface{}) {
+	panic(&ExecError{Err: fmt.Errorf(format, args...)})
+}
+
+// recoverExec turns a panic raised by Context.Errorf into an error stored
+// in errp. Any other panic is passed on.
+func recoverExec(errp *error) {
+	if e := recover(); e != nil {
+		err, ok := e.(*ExecError)
+		if !ok {
+			panic(e)
+		}
+		*errp = err
+	}
+}
@@ -0,0 +1,145 @@
+package template
+
+import (
+	"io"
+	"path"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// A SafeString is a string that's safe to include in HTML as is. Values
+// printed by a template that autoescapes are HTML-escaped unless they're
+// SafeStrings. Filters can return a SafeString to mark their output safe.
+type SafeString string
+
+var safeStringType = reflect.TypeOf(SafeString(""))
+
+func (s SafeString) Bool() bool { return s != "" }
+
+func (s SafeString) Int() int64 {
+	if i, err := strconv.ParseInt(string(s), 10, 64); err == nil {
+		return i
+	}
+	return 0
+}
+
+func (s SafeString) Float() float64 { return stringValue(s).Float() }
+
+func (s SafeString) String() string { return string(s) }
+
+func (s SafeString) Uint() uint64 {
+	if i, err := strconv.ParseUint(string(s), 10, 64); err == nil {
+		return i
+	}
+	return 0
+}
+
+func (s SafeString) Reflect() reflect.Value               { return reflect.ValueOf(s) }
+func (s SafeString) Render(w io.Writer, c *Context) error { return writeString(w, string(s)) }
+
+// isSafe reports whether v needs no escaping.
+func isSafe(v Value) bool {
+	switch v.(type) {
+	case SafeString, superValue:
+		return true
+	}
+	return false
+}
+
+// keepSafe returns s as a SafeString if in is one. It's for filters whose
+// output is safe whenever their input is.
+func keepSafe(in Value, s string) Value {
+	if _, ok := in.(SafeString); ok {
+		return SafeString(s)
+	}
+	return stringValue(s)
+}
+
+var htmlReplacer = strings.NewReplacer(
+	"&", "&amp;",
+	"<", "&lt;",
+	">", "&gt;",
+	"'", "&#39;",
+	`"`, "&quot;",
+)
+
+func escapeHTML(s string) string {
+	return htmlReplacer.Replace(s)
+}
+
+// An escMode says whether values are escaped.
+type escMode uint8
+
+const (
+	escDefault escMode = iota // decided by the template's options and name
+	escOn
+	escOff
+)
+
+// autoescapes reports whether a template with the given name escapes the
+// values it prints outside of autoescape tags.
+func (o options) autoescapes(name string) bool {
+	switch o.autoescape {
+	case escOn:
+		return true
+	case escOff:
+		return false
+	}
+	switch strings.ToLower(path.Ext(name)) {
+	case ".html", ".htm", ".xhtml", ".xml":
+		return true
+	}
+	return false
+}
+
+// An escaping says how a tag that prints a value escapes it.
+type escaping struct {
+	mode escMode
+	ctx  htmlContext // where the value appears, for escape=contextual
+}
+
+// renderValue writes val to wr, escaping it if esc or, by default, the
+// template says to.
+func renderValue(wr io.Writer, c *Context, val Value, esc escaping) error {
+	if esc.mode == escOff || esc.mode == escDefault && !c.autoescape {
+		return val.Render(wr, c)
+	}
+	if _, ok := val.(superValue); ok {
+		// the output of the template itself
+		return val.Render(wr, c)
+	}
+	if c.opts.contextual {
+		return writeString(wr, esc.ctx.escape(val))
+	}
+	if isSafe(val) {
+		return val.Render(wr, c)
+	}
+	return writeString(wr, escapeHTML(val.String()))
+}
+
+// parseAutoescape parses an autoescape tag, which turns autoescaping on or
+// off for its body:
+//
+//	{% autoescape on %}...{% endautoescape %}
+func parseAutoescape(p *Parser) Node {
+	var mode escMode
+	switch p.Lit() {
+	case "on":
+		mode = escOn
+	case "off":
+		mode = escOff
+	default:
+		p.Error("autoescape tag requires on or off")
+	}
+	p.Next()
+	p.Expect(TokTagEnd)
+	old := p.esc
+	p.esc = mode
+	defer func() { p.esc = old }()
+	tok, nodes := p.ParseUntil("endautoescape")
+	if tok != "endautoescape" {
+		p.Error("unterminated autoescape tag")
+	}
+	return nodes
+}
@@ -0,0 +1,94 @@
+package template
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+var escapeTests = []templateTest{
+	{"{{ s }}", c{"s": "<b>"}, "&lt;b&gt;"},
+	{"{{ s }}", c{"s": SafeString("<b>")}, "<b>"},
+	{"{{ s|safe }}", c{"s": "<b>"}, "<b>"},
+	{"{{ s|mark_safe }}", c{"s": "<b>"}, "<b>"},
+	{"{{ s|escape }}", c{"s": "<b>"}, "&lt;b&gt;"},
+	{"{{ s|escape|escape }}", c{"s": "<b>"}, "&lt;b&gt;"},
+	{"{{ s|safe|escape }}", c{"s": "<b>"}, "<b>"},
+	{"{{ s|safe|lower }}", c{"s": "<B>"}, "<b>"},
+	{"{{ s|safe|capfirst }}", c{"s": "<b>"}, "<b>"},
+	{"{{ s|safe|cut:'b' }}", c{"s": "<b>"}, "&lt;&gt;"},
+	{"{{ s|shout }}", c{"s": "<b>"}, "<b>!"},
+	{"{{ s }}", c{"s": `'&"`}, "&#39;&amp;&quot;"},
+	{"{% autoescape off %}{{ s }}{% endautoescape %}{{ s }}", c{"s": "<b>"}, "<b>&lt;b&gt;"},
+	{"{% autoescape off %}{% autoescape on %}{{ s }}{% endautoescape %}{{ s }}{% endautoescape %}", c{"s": "<b>"}, "&lt;b&gt;<b>"},
+	{"{% cycle s 1 %}{% firstof 0 s %}", c{"s": "<b>"}, "&lt;b&gt;&lt;b&gt;"},
+	{"{% autoescape off %}{% cycle s 1 %}{% firstof 0 s %}{% endautoescape %}", c{"s": "<b>"}, "<b><b>"},
+	{"{% extends 'base.html' %}{% block b %}{{ block.super }}{{ s }}{% endblock %}", c{"s": "<b>"}, "[&lt;b&gt;&lt;b&gt;]"},
+}
+
+func escapeEnv() *Environment {
+	env := NewEnvironment()
+	env.RegisterFilterFunc("shout", func(s string) SafeString { return SafeString(s + "!") })
+	env.SetLoader(NewMapLoader(env, map[string]string{
+		"base.html": "[{% block b %}{{ s }}{% endblock %}]",
+		"page.html": "{{ s }}",
+		"page.HTM":  "{{ s }}",
+		"page.txt":  "{{ s }}",
+		"page.xml":  "{% include 'page.txt' %}",
+	}))
+	return env
+}
+
+func TestAutoescape(t *testing.T) {
+	env := escapeEnv().Option("autoescape=on")
+	testEnv(t, env, escapeTests)
+}
+
+func TestAutoescapeByName(t *testing.T) {
+	tests := []struct {
+		name string
+		opt  string
+		out  string
+	}{
+		{"page.html", "autoescape=auto", "&lt;b&gt;"},
+		{"page.HTM", "autoescape=auto", "&lt;b&gt;"},
+		{"page.txt", "autoescape=auto", "<b>"},
+		{"page.xml", "autoescape=auto", "<b>"},
+		{"page.html", "autoescape=off", "<b>"},
+		{"page.txt", "autoescape=on", "&lt;b&gt;"},
+	}
+	for _, test := range tests {
+		env := escapeEnv().Option(test.opt)
+		temp, err := env.Load(test.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		if err := temp.Execute(&buf, c{"s": "<b>"}); err != nil {
+			t.Errorf("%s with %s: %s", test.name, test.opt, err)
+		}
+		if buf.String() != test.out {
+			t.Errorf("%s with %s: got %q want %q", test.name, test.opt, buf.String(), test.out)
+		}
+	}
+
+	// unnamed templates don't escape by default
+	temp := MustParseString("{{ s }}")
+	var buf bytes.Buffer
+	if err := temp.Execute(&buf, c{"s": "<b>"}); err != nil || buf.String() != "<b>" {
+		t.Errorf("got %q, %v", buf.String(), err)
+	}
+}
+
+func TestAutoescapeErrors(t *testing.T) {
+	for _, s := range []string{
+		"{% autoescape %}{% endautoescape %}",
+		"{% autoescape maybe %}{% endautoescape %}",
+		"{% autoescape on %}",
+	} {
+		_, err := ParseString(s)
+		if err == nil || !strings.Contains(err.Error(), "autoescape") {
+			t.Errorf("%q: got error %v", s, err)
+		}
+	}
+}
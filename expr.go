@@ -1,9 +1,9 @@
 package template
 
 import (
+	"fmt"
 	"reflect"
 	"strconv"
-	"unicode/utf8"
 )
 
 // Expr represents an expression that can be evaluated at runtime.
@@ -17,45 +17,202 @@ type constExpr struct {
 
 func (e constExpr) Eval(c *Context) Value { return e.v }
 
+// A varExpr is a variable named in the template.
+type varExpr struct {
+	v    Variable
+	name string
+	pos  Position
+}
+
+func (e *varExpr) Eval(c *Context) Value {
+	if val := c.stack[e.v]; val != nil {
+		return val
+	}
+	// newContext only sets the variables that are fields or elements of
+	// the data, since calling methods that may not be used is wasteful
+	ref, err := callMethod(c.data, e.name)
+	if err != nil {
+		panic(&ExecError{e.pos, fmt.Errorf("%s: %w", e.name, err)})
+	}
+	if ref.IsValid() {
+		val := refToVal(ref)
+		e.v.Set(val, c)
+		return val
+	}
+	if c.opts.strict {
+		panic(&ExecError{e.pos, fmt.Errorf("undefined variable %q", e.name)})
+	}
+	return nilValue(0)
+}
+
 type attrExpr struct {
 	x    Expr
 	attr string
+	pos  Position
 }
 
 func (e *attrExpr) Eval(c *Context) Value {
 	val := e.x.Eval(c)
+	if b, ok := val.(blockValue); ok {
+		if e.attr == "super" {
+			return b.super
+		}
+		return missing(c, e, e.pos, nilValue(0))
+	}
 	ref := val.Reflect()
 
 	// apply attributes
 	k := ref.Kind()
 	if reflect.Bool <= k && k <= reflect.Complex128 {
 		// invalid; do nothing
-		return val
+		return missing(c, e, e.pos, val)
 	} else if k == reflect.String {
 		str := val.String()
 		idx, err := strconv.Atoi(e.attr)
 		if err != nil {
 			// invalid; do nothing
-			return val
+			return missing(c, e, e.pos, val)
 		}
-		var n, i int
-		var c rune
-		for i, c = range str {
+		n := 0
+		for _, ch := range str {
 			if n == idx {
-				break
+				return stringValue(ch)
 			}
 			n++
 		}
-		return stringValue(str[i : i+utf8.RuneLen(c)])
+		return missing(c, e, e.pos, nilValue(0))
 	}
 
-	ref = lookup(ref, e.attr)
+	ref, err := lookupAttr(ref, e.attr)
+	if err != nil {
+		panic(&ExecError{e.pos, fmt.Errorf("%s: %w", exprPath(e), err)})
+	}
 	if ref.Kind() == reflect.Invalid {
-		return nilValue(0)
+		return missing(c, e, e.pos, nilValue(0))
 	}
 	return refToVal(ref)
 }
 
+// An indexExpr is a subscript, x[key].
+type indexExpr struct {
+	x, key Expr
+	pos    Position // of the [
+}
+
+func (e *indexExpr) Eval(c *Context) Value {
+	val := e.x.Eval(c)
+	ref, err := index(val.Reflect(), e.key.Eval(c))
+	if err != nil {
+		panic(&ExecError{e.pos, fmt.Errorf("%s: %w", exprPath(e), err)})
+	}
+	if !ref.IsValid() {
+		return missing(c, e, e.pos, nilValue(0))
+	}
+	return refToVal(ref)
+}
+
+// A sliceExpr is a slice, x[low:high], where either bound may be left out.
+type sliceExpr struct {
+	x, low, high Expr
+	pos          Position // of the [
+}
+
+func (e *sliceExpr) Eval(c *Context) Value {
+	val := e.x.Eval(c)
+	ref := reflect.Indirect(val.Reflect())
+	var runes []rune
+	switch ref.Kind() {
+	case reflect.Invalid:
+		return missing(c, e, e.pos, nilValue(0))
+	case reflect.String:
+		runes = []rune(ref.String())
+	case reflect.Array:
+		if !ref.CanAddr() && ref.CanInterface() {
+			a := reflect.New(ref.Type()).Elem()
+			a.Set(ref)
+			ref = a
+		}
+		if !ref.CanAddr() {
+			panic(&ExecError{e.pos, fmt.Errorf("can't slice %s", exprPath(e.x))})
+		}
+	case reflect.Slice:
+	default:
+		panic(&ExecError{e.pos, fmt.Errorf("can't slice %s", cmpTypeName(val))})
+	}
+	n := len(runes)
+	if runes == nil {
+		n = ref.Len()
+	}
+	low := e.bound(c, e.low, 0, n)
+	high := e.bound(c, e.high, n, n)
+	if high < low {
+		high = low
+	}
+	if runes != nil {
+		return keepSafe(val, string(runes[low:high]))
+	}
+	return refToVal(ref.Slice(low, high))
+}
+
+// bound evaluates the bound x of a slice of a sequence of length n,
+// returning def if it's left out. Like in Python, negative bounds count
+// from the end and bounds out of range are moved to the nearest end.
+func (e *sliceExpr) bound(c *Context, x Expr, def, n int) int {
+	if x == nil {
+		return def
+	}
+	v := x.Eval(c)
+	i, ok := intKey(v)
+	if !ok {
+		panic(&ExecError{e.pos, fmt.Errorf("slice index %s isn't an integer", quoteString(v))})
+	}
+	if i < 0 {
+		i += int64(n)
+	}
+	if i < 0 {
+		return 0
+	} else if i > int64(n) {
+		return n
+	}
+	return int(i)
+}
+
+// missing returns val as the value of the attribute or element e that
+// doesn't exist, or stops execution at pos if the undefined=error option is
+// set.
+func missing(c *Context, e Expr, pos Position, val Value) Value {
+	if c.opts.strict {
+		panic(&ExecError{pos, fmt.Errorf("undefined attribute %q", exprPath(e))})
+	}
+	return val
+}
+
+// exprPath returns the dotted path of e, such as "user.name", for use in
+// error messages.
+func exprPath(e Expr) string {
+	switch e := e.(type) {
+	case *varExpr:
+		return e.name
+	case *attrExpr:
+		return exprPath(e.x) + "." + e.attr
+	case *indexExpr:
+		return exprPath(e.x) + "[" + exprPath(e.key) + "]"
+	case *sliceExpr:
+		path := exprPath(e.x) + "["
+		if e.low != nil {
+			path += exprPath(e.low)
+		}
+		path += ":"
+		if e.high != nil {
+			path += exprPath(e.high)
+		}
+		return path + "]"
+	case constExpr:
+		return quoteString(e.v)
+	}
+	return "(...)"
+}
+
 type filterExpr struct {
 	x       Expr
 	filters []*filter
@@ -65,7 +222,7 @@ func (e *filterExpr) Eval(c *Context) Value {
 	val := e.x.Eval(c)
 	// apply filters
 	for _, f := range e.filters {
-		val = f.f(constExpr{val}, c, f.args)
+		val = f.apply(val, c)
 	}
 	return val
 }
@@ -81,7 +238,7 @@ func (u *unaryExpr) Eval(c *Context) Value {
 	case TokAdd:
 		return val
 	case TokSub:
-		return intValue(-val.Int())
+		return negate(val)
 	case TokNot:
 		return boolValue(!val.Bool())
 	}
@@ -91,45 +248,35 @@ func (u *unaryExpr) Eval(c *Context) Value {
 type binaryExpr struct {
 	op          Token
 	left, right Expr
+	pos         Position // of the operator
 }
 
 func (b *binaryExpr) Eval(c *Context) Value {
 	l := b.left.Eval(c)
 	r := b.right.Eval(c)
 	switch b.op {
-	case TokAdd:
-		// TODO: Floats will be truncated; other results might be unexpected
-		return intValue(l.Int() + r.Int())
-	case TokSub:
-		return intValue(l.Int() - r.Int())
-	case TokMul:
-		return intValue(l.Int() * r.Int())
-	case TokDiv:
-		divisor := r.Int()
-		if divisor == 0 {
-			return stringValue("NaN")
+	case TokAdd, TokSub, TokMul, TokDiv, TokRem:
+		val, err := arith(b.op, l, r)
+		if err != nil {
+			panic(&ExecError{b.pos, err})
 		}
-		return intValue(l.Int() / divisor)
-	case TokRem:
-		return intValue(l.Int() % r.Int())
+		return val
 	case TokAnd:
 		return boolValue(l.Bool() && r.Bool())
 	case TokOr:
 		return boolValue(l.Bool() || r.Bool())
-	case TokEqual:
-		// TODO: Make sure types are comparable
-		return boolValue(l == r)
-	case TokNotEq:
-		// TODO: Make sure types are comparable
-		return boolValue(l != r)
-	case TokLess:
-		return boolValue(l.Int() < r.Int())
-	case TokLessEq:
-		return boolValue(l.Int() <= r.Int())
-	case TokGreater:
-		return boolValue(l.Int() > r.Int())
-	case TokGreaterEq:
-		return boolValue(l.Int() >= r.Int())
+	case TokEqual, TokNotEq, TokLess, TokLessEq, TokGreater, TokGreaterEq:
+		ok, err := compare(b.op, l, r, c.opts.strict)
+		if err != nil {
+			panic(&ExecError{b.pos, err})
+		}
+		return boolValue(ok)
+	case TokIn, TokNotIn:
+		ok, err := contains(r, l)
+		if err != nil {
+			panic(&ExecError{b.pos, err})
+		}
+		return boolValue(ok == (b.op == TokIn))
 	}
 	panic("unreachable")
 }
@@ -1,33 +1,58 @@
 package template
 
 import (
+	"fmt"
 	"reflect"
 	"strings"
 	"unicode"
 	"unicode/utf8"
 )
 
-type filterFunc func(in Expr, c *Context, arg Expr) Value
+// A FilterFunc implements a filter. in is the expression being filtered and
+// arg is the filter's argument, or nil if it has none. A FilterFunc that
+// fails can stop execution with c.Errorf. A FilterFunc whose result needs no
+// HTML escaping should return a SafeString.
+type FilterFunc func(in Expr, c *Context, arg Expr) Value
 
 type filter struct {
-	f    filterFunc
+	name string
+	pos  Position
+	f    FilterFunc
 	args Expr
 }
 
-type argType int
+// apply runs the filter on val. Errors raised by the FilterFunc are reported
+// at the filter's position.
+func (f *filter) apply(val Value, c *Context) Value {
+	defer f.recover()
+	return f.f(constExpr{val}, c, f.args)
+}
+
+func (f *filter) recover() {
+	if e := recover(); e != nil {
+		if err, ok := e.(*ExecError); ok && err.Line == 0 {
+			err.Position = f.pos
+			err.Err = fmt.Errorf("filter %q: %w", f.name, err.Err)
+		}
+		panic(e)
+	}
+}
+
+// An ArgType says whether a filter takes an argument.
+type ArgType int
 
 const (
-	NoArg  argType = iota // No argument allowed
+	NoArg  ArgType = iota // No argument allowed
 	OptArg                // Optional argument
 	ReqArg                // Argument required
 )
 
 type regFilter struct {
-	f   filterFunc
-	arg argType
+	f   FilterFunc
+	arg ArgType
 }
 
-var filters = map[string]*regFilter{
+var builtinFilters = map[string]*regFilter{
 	"addslashes":     &regFilter{addslashesFilter, NoArg},
 	"capfirst":       &regFilter{capfirstFilter, NoArg},
 	"center":         &regFilter{centerFilter, ReqArg},
@@ -37,6 +62,138 @@ var filters = map[string]*regFilter{
 	"escape":         &regFilter{escapeFilter, NoArg},
 	"first":          &regFilter{firstFilter, NoArg},
 	"lower":          &regFilter{lowerFilter, NoArg},
+	"mark_safe":      &regFilter{safeFilter, NoArg},
+	"safe":           &regFilter{safeFilter, NoArg},
+}
+
+var (
+	valueType = reflect.TypeOf((*Value)(nil)).Elem()
+	errorType = reflect.TypeOf((*error)(nil)).Elem()
+)
+
+// AdaptFilter converts an ordinary Go function to a FilterFunc.
+//
+// The function's first parameter receives the filtered value. A second
+// parameter receives the filter's argument and makes it required; if the
+// second parameter is variadic, the argument is optional. Parameters of type
+// bool, string, or a numeric type receive the template value converted to
+// that type. Parameters of type Value receive the template value itself.
+// Parameters of any other type receive the underlying Go value, which must
+// be assignable to the parameter's type.
+//
+// The function must return a single result, which becomes the filter's
+// value, and may return an error as a second result, which stops execution.
+func AdaptFilter(fn interface{}) (FilterFunc, ArgType, error) {
+	f := reflect.ValueOf(fn)
+	if f.Kind() != reflect.Func {
+		return nil, 0, fmt.Errorf("template: filter %T is not a function", fn)
+	}
+	t := f.Type()
+	var arg ArgType
+	switch {
+	case t.NumIn() == 1 && !t.IsVariadic():
+		arg = NoArg
+	case t.NumIn() == 2 && t.IsVariadic():
+		arg = OptArg
+	case t.NumIn() == 2:
+		arg = ReqArg
+	default:
+		return nil, 0, fmt.Errorf("template: filter %s must take one or two arguments, the second of which may be variadic", t)
+	}
+	in := []reflect.Type{t.In(0)}
+	if arg != NoArg {
+		in = append(in, t.In(1))
+	}
+	if arg == OptArg {
+		in[1] = in[1].Elem()
+	}
+	for _, typ := range in {
+		switch typ.Kind() {
+		case reflect.Func, reflect.UnsafePointer:
+			return nil, 0, fmt.Errorf("template: filter %s can't take an argument of type %s", t, typ)
+		}
+	}
+	switch {
+	case t.NumOut() == 1:
+	case t.NumOut() == 2 && t.Out(1) == errorType:
+	default:
+		return nil, 0, fmt.Errorf("template: filter %s must return one value and optionally an error", t)
+	}
+
+	filter := func(inExpr Expr, c *Context, argExpr Expr) Value {
+		args := make([]reflect.Value, 1, 2)
+		args[0] = convertValue(inExpr.Eval(c), in[0], c)
+		if argExpr != nil {
+			args = append(args, convertValue(argExpr.Eval(c), in[1], c))
+		}
+		out := f.Call(args)
+		if len(out) == 2 && !out[1].IsNil() {
+			c.Errorf("%w", out[1].Interface().(error))
+		}
+		if out[0].Type() == valueType {
+			if out[0].IsNil() {
+				return nilValue(0)
+			}
+			return out[0].Interface().(Value)
+		}
+		return refToVal(out[0])
+	}
+	return filter, arg, nil
+}
+
+// convertValue converts v to a Go value of type t as described by
+// AdaptFilter, stopping execution if that's impossible.
+func convertValue(v Value, t reflect.Type, c *Context) reflect.Value {
+	if t == valueType {
+		return reflect.ValueOf(&v).Elem()
+	}
+	switch t.Kind() {
+	case reflect.Bool:
+		return reflect.ValueOf(v.Bool()).Convert(t)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return reflect.ValueOf(v.Int()).Convert(t)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return reflect.ValueOf(v.Uint()).Convert(t)
+	case reflect.Float32, reflect.Float64:
+		return reflect.ValueOf(v.Float()).Convert(t)
+	case reflect.String:
+		return reflect.ValueOf(v.String()).Convert(t)
+	}
+	ref := goValue(v)
+	if !ref.IsValid() {
+		return reflect.Zero(t)
+	}
+	if !ref.Type().AssignableTo(t) {
+		c.Errorf("can't use %s as %s", ref.Type(), t)
+	}
+	ret := reflect.New(t).Elem()
+	ret.Set(ref)
+	return ret
+}
+
+// goValue returns the Go value held by v. Values created by the template
+// itself, such as literals, are converted to the corresponding predeclared
+// type.
+func goValue(v Value) reflect.Value {
+	ref := v.Reflect()
+	if !ref.IsValid() || ref.Type().PkgPath() != valueType.PkgPath() {
+		return ref
+	}
+	switch ref.Kind() {
+	case reflect.Bool:
+		return reflect.ValueOf(ref.Bool())
+	case reflect.Int64:
+		return reflect.ValueOf(ref.Int())
+	case reflect.Uint64:
+		return reflect.ValueOf(ref.Uint())
+	case reflect.Float64:
+		return reflect.ValueOf(ref.Float())
+	case reflect.Complex128:
+		return reflect.ValueOf(ref.Complex())
+	case reflect.String:
+		return reflect.ValueOf(ref.String())
+	}
+	return ref
 }
 
 func addslashesFilter(in Expr, c *Context, arg Expr) Value {
@@ -56,7 +213,7 @@ func capfirstFilter(in Expr, c *Context, arg Expr) Value {
 	// This assumes that the upper case rune is the same width as the lower case rune.
 	// It's almost always true (might even be always).
 	utf8.EncodeRune(b, rune)
-	return stringValue(b)
+	return keepSafe(inVal, string(b))
 }
 
 func centerFilter(in Expr, c *Context, arg Expr) Value {
@@ -76,9 +233,9 @@ func centerFilter(in Expr, c *Context, arg Expr) Value {
 	count = count - half
 	if count == half {
 		spaces := strings.Repeat(" ", count)
-		return stringValue(spaces + str + spaces)
+		return keepSafe(inVal, spaces+str+spaces)
 	}
-	return stringValue(strings.Repeat(" ", half) + str + strings.Repeat(" ", count))
+	return keepSafe(inVal, strings.Repeat(" ", half)+str+strings.Repeat(" ", count))
 }
 
 func cutFilter(in Expr, c *Context, arg Expr) Value {
@@ -120,16 +277,15 @@ func dictsortreversedFilter(in Expr, c *Context, arg Expr) Value {
 	return in.Eval(c)
 }
 
-// TODO: This isn't quite right; this filter should work anywhere in a filter chain so it probably needs to be treated specially
+// escapeFilter HTML-escapes its input and marks the result safe, so it
+// isn't escaped again by autoescaping. Input that's already safe is left
+// alone.
 func escapeFilter(in Expr, c *Context, arg Expr) Value {
-	str := in.Eval(c).String()
-	// TODO: We can probably get better performance by implementing this ourselves
-	str = strings.Replace(str, "&", "&amp;", -1)
-	str = strings.Replace(str, "<", "&lt;", -1)
-	str = strings.Replace(str, ">", "&gt;", -1)
-	str = strings.Replace(str, "'", "&#39;", -1)
-	str = strings.Replace(str, "\"", "&quot;", -1)
-	return stringValue(str)
+	inVal := in.Eval(c)
+	if isSafe(inVal) {
+		return inVal
+	}
+	return SafeString(escapeHTML(inVal.String()))
 }
 
 func escapejsFilter(in Expr, c *Context, arg Expr) Value {
@@ -232,8 +388,8 @@ func ljustFilter(in Expr, c *Context, arg Expr) Value {
 }
 
 func lowerFilter(in Expr, c *Context, arg Expr) Value {
-	str := in.Eval(c).String()
-	return stringValue(strings.ToLower(str))
+	inVal := in.Eval(c)
+	return keepSafe(inVal, strings.ToLower(inVal.String()))
 }
 
 func makeListFilter(in Expr, c *Context, arg Expr) Value {
@@ -287,3 +443,12 @@ func rjustFilter(in Expr, c *Context, arg Expr) Value {
 	count -= len(runes)
 	return stringValue(strings.Repeat(" ", count) + str)
 }
+
+// safeFilter marks its input safe, so it isn't escaped by autoescaping.
+func safeFilter(in Expr, c *Context, arg Expr) Value {
+	inVal := in.Eval(c)
+	if isSafe(inVal) {
+		return inVal
+	}
+	return SafeString(inVal.String())
+}
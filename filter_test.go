@@ -1,6 +1,10 @@
 package template
 
 import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
 	"testing"
 )
 
@@ -39,3 +43,75 @@ var filterTests = []templateTest{
 func TestFilters(t *testing.T) {
 	testTemplates(t, filterTests)
 }
+
+func TestRegisterFilter(t *testing.T) {
+	env := NewEnvironment()
+	env.RegisterFilter("twice", func(in Expr, c *Context, arg Expr) Value {
+		s := in.Eval(c).String()
+		if arg != nil {
+			s += arg.Eval(c).String()
+		}
+		return ValueOf(s + s)
+	}, OptArg)
+	env.RegisterFilterFunc("repeat", strings.Repeat)
+	env.RegisterFilterFunc("half", func(f float64) float64 { return f / 2 })
+	env.RegisterFilterFunc("join", func(in []string, sep ...string) string {
+		if len(sep) == 0 {
+			return strings.Join(in, ", ")
+		}
+		return strings.Join(in, sep[0])
+	})
+	env.RegisterFilterFunc("kind", func(v interface{}) string { return fmt.Sprintf("%T", v) })
+	env.RegisterFilterFunc("atoi", strconv.Atoi)
+
+	testEnv(t, env, []templateTest{
+		{"{{ 'ab'|twice }} {{ 'ab'|twice:'c' }}", nil, "abab abcabc"},
+		{"{{ var|repeat:3 }} {{ 'x'|capfirst|repeat:n }}", c{"var": "ab", "n": "2"}, "ababab XX"},
+		{"{{ 3|half }} {{ '5'|half }}", nil, "1.5 2.5"},
+		{"{{ var|join }} {{ var|join:'-' }}", c{"var": []string{"a", "b"}}, "a, b a-b"},
+		{"{{ 1|kind }} {{ 'a'|kind }} {{ var|kind }} {{ nothing|kind }}", c{"var": []int{1}}, "int64 string []int <nil>"},
+		{"{{ '42'|atoi }}", nil, "42"},
+	})
+}
+
+func TestAdaptFilterErrors(t *testing.T) {
+	bad := []interface{}{
+		"not a function",
+		func() string { return "" },
+		func(a, b, c string) string { return "" },
+		func(a ...string) string { return "" },
+		func(s string) {},
+		func(s string) (string, string) { return "", "" },
+		func(f func()) string { return "" },
+	}
+	for i, fn := range bad {
+		if _, _, err := AdaptFilter(fn); err == nil {
+			t.Errorf("#%d AdaptFilter(%T) succeeded", i, fn)
+		}
+	}
+}
+
+func TestFilterRuntimeError(t *testing.T) {
+	env := NewEnvironment()
+	env.RegisterFilterFunc("mustatoi", strconv.Atoi)
+	env.RegisterFilterFunc("sum", func(in []int) int { return len(in) })
+	tests := []struct {
+		template string
+		err      string
+	}{
+		{"abc\n{{ 'x'|mustatoi }}", `2:8: filter "mustatoi": strconv.Atoi: parsing "x": invalid syntax`},
+		{"{{ var|sum }}", `1:8: filter "sum": can't use string as []int`},
+	}
+	for i, test := range tests {
+		temp, err := env.ParseString(test.template)
+		if err != nil {
+			t.Errorf("#%d failed to parse: %s", i, err)
+			continue
+		}
+		var buf bytes.Buffer
+		err = temp.Execute(&buf, c{"var": "a"})
+		if _, ok := err.(*ExecError); !ok || err.Error() != test.err {
+			t.Errorf("#%d got error %v want %s", i, err, test.err)
+		}
+	}
+}
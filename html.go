@@ -0,0 +1,618 @@
+package template
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"reflect"
+	"strings"
+	"unicode/utf8"
+)
+
+// An htmlContext describes where in an HTML document a position in a
+// template's source falls. The parser tracks it across the template's text
+// so that with the escape=contextual option, each value can be escaped as
+// appropriate for its position. The branches of if, ifchanged and for tags
+// must end in compatible contexts, blocks start where the block they
+// replace is, and included templates must be in text and end there. Tags
+// registered with RegisterTag are followed in source order.
+type htmlContext struct {
+	state   htmlState
+	element element  // the element whose start tag is being read
+	attr    attrType // the type of the attribute being read
+	delim   delim    // what ends the attribute value
+	js      jsState  // in script content or a JavaScript attribute
+	url     urlPart  // in a URL attribute
+}
+
+type htmlState uint8
+
+const (
+	stateText        htmlState = iota // text outside of tags
+	stateTag                          // in a tag, between attributes
+	stateAttrName                     // in an attribute name
+	stateAfterName                    // after an attribute name
+	stateBeforeValue                  // after the "=" of an attribute
+	stateAttr                         // in an attribute value
+	stateScript                       // in the content of a script element
+	stateStyle                        // in the content of a style element
+	stateComment                      // in an HTML comment
+)
+
+type element uint8
+
+const (
+	elementNone element = iota
+	elementScript
+	elementStyle
+)
+
+type attrType uint8
+
+const (
+	attrNormal attrType = iota
+	attrJS              // an event handler such as onclick
+	attrCSS             // the style attribute
+	attrURL             // an attribute holding a URL, such as href
+)
+
+type delim uint8
+
+const (
+	delimNone delim = iota
+	delimDouble
+	delimSingle
+	delimSpace // an unquoted value, ended by a space or '>'
+)
+
+// A jsState is where in JavaScript code a position falls.
+type jsState struct {
+	mode jsMode
+	// div is set in code when a '/' would be a division rather than the
+	// start of a regular expression.
+	div bool
+}
+
+type jsMode uint8
+
+const (
+	jsCode jsMode = iota
+	jsDoubleQuote
+	jsSingleQuote
+	jsBackQuote
+	jsRegexp
+	jsRegexpClass // in a [...] class in a regular expression
+	jsLineComment
+	jsBlockComment
+)
+
+type urlPart uint8
+
+const (
+	urlStart   urlPart = iota // nothing of the URL read yet
+	urlPath                   // in the scheme, host or path
+	urlQuery                  // in the query or fragment
+	urlUnknown                // after branches that end in different parts
+)
+
+// A blockContext is the HTML context at the start and end of a block.
+type blockContext struct {
+	start, end htmlContext
+}
+
+// next returns the context after the text s.
+func (ctx htmlContext) next(s []byte) htmlContext {
+	var name []byte // the attribute name being read
+	for i := 0; i < len(s); i++ {
+		b := s[i]
+		switch ctx.state {
+		case stateText:
+			if b != '<' {
+				continue
+			}
+			if bytes.HasPrefix(s[i:], []byte("<!--")) {
+				ctx.state = stateComment
+				i += 3
+				continue
+			}
+			j := i + 1
+			end := j < len(s) && s[j] == '/'
+			if end {
+				j++
+			}
+			k := j
+			for k < len(s) && isTagNameByte(s[k]) {
+				k++
+			}
+			if k == j || !isLetter(s[j]) {
+				continue
+			}
+			ctx = htmlContext{state: stateTag}
+			if !end {
+				ctx.element = elementOf(s[j:k])
+			}
+			i = k - 1
+		case stateComment:
+			if bytes.HasPrefix(s[i:], []byte("-->")) {
+				ctx.state = stateText
+				i += 2
+			}
+		case stateScript, stateStyle:
+			end := "</script"
+			if ctx.state == stateStyle {
+				end = "</style"
+			}
+			if b == '<' && len(s)-i >= len(end) && strings.EqualFold(string(s[i:i+len(end)]), end) {
+				ctx = htmlContext{state: stateTag}
+				i += len(end) - 1
+			} else if ctx.state == stateScript {
+				ctx.js, i = ctx.js.step(s, i)
+			}
+		case stateTag:
+			switch {
+			case b == '>':
+				ctx = ctx.endTag()
+			case isSpace(b) || b == '/':
+			default:
+				ctx.state = stateAttrName
+				name = append(name[:0], b)
+			}
+		case stateAttrName:
+			switch {
+			case b == '=':
+				ctx.state, ctx.attr = stateBeforeValue, attrTypeOf(name)
+			case isSpace(b):
+				ctx.state, ctx.attr = stateAfterName, attrTypeOf(name)
+			case b == '/':
+				ctx.state = stateTag
+			case b == '>':
+				ctx = ctx.endTag()
+			default:
+				name = append(name, b)
+			}
+		case stateAfterName:
+			switch {
+			case b == '=':
+				ctx.state = stateBeforeValue
+			case b == '/':
+				ctx.state = stateTag
+			case b == '>':
+				ctx = ctx.endTag()
+			case isSpace(b):
+			default:
+				ctx.state, ctx.attr = stateAttrName, attrNormal
+				name = append(name[:0], b)
+			}
+		case stateBeforeValue:
+			ctx.js, ctx.url = jsState{}, urlStart
+			switch {
+			case isSpace(b):
+			case b == '"':
+				ctx.state, ctx.delim = stateAttr, delimDouble
+			case b == '\'':
+				ctx.state, ctx.delim = stateAttr, delimSingle
+			case b == '>':
+				ctx = ctx.endTag()
+			default:
+				// the byte is part of an unquoted value
+				ctx.state, ctx.delim = stateAttr, delimSpace
+				i--
+			}
+		case stateAttr:
+			if ctx.delim == delimDouble && b == '"' || ctx.delim == delimSingle && b == '\'' ||
+				ctx.delim == delimSpace && isSpace(b) {
+				ctx.state, ctx.attr, ctx.delim = stateTag, attrNormal, delimNone
+				continue
+			}
+			if ctx.delim == delimSpace && b == '>' {
+				ctx = ctx.endTag()
+				continue
+			}
+			switch ctx.attr {
+			case attrJS:
+				ctx.js, i = ctx.js.step(s, i)
+			case attrURL:
+				if b == '?' || b == '#' {
+					ctx.url = urlQuery
+				} else if ctx.url == urlStart {
+					ctx.url = urlPath
+				}
+			}
+		}
+	}
+	return ctx
+}
+
+// afterValue returns the context after a value printed in ctx.
+func (ctx htmlContext) afterValue() htmlContext {
+	if ctx.state == stateBeforeValue {
+		// the value starts an unquoted attribute value
+		ctx.state, ctx.delim = stateAttr, delimSpace
+		ctx.js, ctx.url = jsState{}, urlStart
+	}
+	switch {
+	case ctx.state == stateScript, ctx.state == stateAttr && ctx.attr == attrJS:
+		if ctx.js.mode == jsCode {
+			// a value is an expression, so a '/' after it divides
+			ctx.js.div = true
+		}
+	case ctx.state == stateAttr && ctx.attr == attrURL && ctx.url == urlStart:
+		ctx.url = urlPath
+	}
+	return ctx
+}
+
+// join returns the context after a tag whose branches end in a and b. It
+// reports false if the contexts are too different to continue from.
+func join(a, b htmlContext) (htmlContext, bool) {
+	if a == b {
+		return a, true
+	}
+	// an attribute name may be printed in one branch only, as in
+	// <input {% if c %}checked{% endif %}>
+	a, b = a.nudge(), b.nudge()
+	if a.url != b.url && a.attr == attrURL {
+		// an error only if a value is printed before the part is known
+		a.url, b.url = urlUnknown, urlUnknown
+	}
+	if a.js.mode == b.js.mode && a.js.div != b.js.div {
+		// assume a '/' starts a regular expression, which escapes more
+		a.js.div, b.js.div = false, false
+	}
+	return a, a == b
+}
+
+// widen returns the context after a block whose own version ends in ctx,
+// allowing for any version that ends in a context that joins with it.
+func (ctx htmlContext) widen() htmlContext {
+	ctx = ctx.nudge()
+	if ctx.attr == attrURL {
+		ctx.url = urlUnknown
+	}
+	ctx.js.div = false
+	return ctx
+}
+
+// fits reports whether a block in the context ctx can replace one in old.
+func (ctx blockContext) fits(old blockContext) bool {
+	_, ok := join(ctx.end, old.end)
+	return ctx.start == old.start && ok
+}
+
+// nudge returns the context in a tag, where an attribute name may or may
+// not have been read, as if one had.
+func (ctx htmlContext) nudge() htmlContext {
+	switch ctx.state {
+	case stateTag, stateAfterName:
+		ctx.state = stateAttrName
+	}
+	return ctx
+}
+
+// endTag returns the context after the '>' that ends a tag.
+func (ctx htmlContext) endTag() htmlContext {
+	switch ctx.element {
+	case elementScript:
+		return htmlContext{state: stateScript}
+	case elementStyle:
+		return htmlContext{state: stateStyle}
+	}
+	return htmlContext{state: stateText}
+}
+
+// step returns the state of JavaScript code after the byte s[i], along with
+// the index of the last byte it used, which is past i after a backslash
+// escape or the two bytes that start or end a comment.
+func (js jsState) step(s []byte, i int) (jsState, int) {
+	b := s[i]
+	var next byte
+	if i+1 < len(s) {
+		next = s[i+1]
+	}
+	switch js.mode {
+	case jsCode:
+		switch {
+		case b == '"':
+			return jsState{mode: jsDoubleQuote}, i
+		case b == '\'':
+			return jsState{mode: jsSingleQuote}, i
+		case b == '`':
+			return jsState{mode: jsBackQuote}, i
+		case b == '/' && next == '/':
+			return jsState{mode: jsLineComment}, i + 1
+		case b == '/' && next == '*':
+			return jsState{mode: jsBlockComment}, i + 1
+		case b == '/' && !(js.div && !afterKeyword(s[:i])):
+			return jsState{mode: jsRegexp}, i
+		case isSpace(b):
+			return js, i
+		}
+		// a '/' after a name, number or closing bracket divides
+		js.div = isJSNameByte(b) || b == ')' || b == ']'
+		return js, i
+	case jsLineComment:
+		if b == '\n' || b == '\r' {
+			return jsState{}, i
+		}
+		return js, i
+	case jsBlockComment:
+		if b == '*' && next == '/' {
+			return jsState{}, i + 1
+		}
+		return js, i
+	}
+	switch {
+	case b == '\\':
+		return js, i + 1
+	case js.mode == jsRegexp && b == '[':
+		return jsState{mode: jsRegexpClass}, i
+	case js.mode == jsRegexpClass && b == ']':
+		return jsState{mode: jsRegexp}, i
+	case js.mode == jsRegexp && b == '/':
+		// the flags that may follow are names, so a '/' after them divides
+		return jsState{div: true}, i
+	case js.mode == jsDoubleQuote && b == '"', js.mode == jsSingleQuote && b == '\'', js.mode == jsBackQuote && b == '`':
+		return jsState{div: true}, i
+	}
+	return js, i
+}
+
+func isJSNameByte(b byte) bool {
+	return isLetter(b) || '0' <= b && b <= '9' || b == '_' || b == '$' || b >= utf8.RuneSelf
+}
+
+// afterKeyword reports whether code ends with a keyword after which a '/'
+// starts a regular expression, such as return.
+func afterKeyword(code []byte) bool {
+	code = bytes.TrimRight(code, " \t\n\f\r")
+	i := len(code)
+	for i > 0 && isJSNameByte(code[i-1]) {
+		i--
+	}
+	switch string(code[i:]) {
+	case "return", "typeof", "instanceof", "in", "of", "new", "delete", "void", "throw", "case", "do", "else", "yield", "await":
+		return true
+	}
+	return false
+}
+
+func elementOf(name []byte) element {
+	switch strings.ToLower(string(name)) {
+	case "script":
+		return elementScript
+	case "style":
+		return elementStyle
+	}
+	return elementNone
+}
+
+func attrTypeOf(name []byte) attrType {
+	n := strings.ToLower(string(name))
+	switch {
+	case strings.HasPrefix(n, "on"):
+		return attrJS
+	case n == "style":
+		return attrCSS
+	case strings.Contains(n, "url"), strings.Contains(n, "uri"):
+		return attrURL
+	}
+	switch n {
+	case "href", "src", "action", "formaction", "cite", "poster", "background", "longdesc", "usemap", "codebase":
+		return attrURL
+	}
+	return attrNormal
+}
+
+func isSpace(b byte) bool {
+	switch b {
+	case ' ', '\t', '\n', '\f', '\r':
+		return true
+	}
+	return false
+}
+
+func isLetter(b byte) bool {
+	return 'a' <= b && b <= 'z' || 'A' <= b && b <= 'Z'
+}
+
+func isTagNameByte(b byte) bool {
+	return isLetter(b) || '0' <= b && b <= '9' || b == '-' || b == ':'
+}
+
+// escape returns v escaped for ctx. SafeStrings are trusted in text and
+// in ordinary quoted attribute values, where they'd otherwise be
+// HTML-escaped; everywhere else they're escaped like any other string.
+func (ctx htmlContext) escape(v Value) string {
+	_, safe := v.(SafeString)
+	switch ctx.state {
+	case stateText, stateComment:
+		if safe {
+			return v.String()
+		}
+		return escapeHTML(v.String())
+	case stateScript:
+		return ctx.js.escape(v)
+	case stateStyle:
+		return escapeCSS(v.String())
+	case stateTag, stateAttrName, stateAfterName:
+		return escapeHTMLNospace(v.String())
+	}
+
+	// an attribute value
+	var s string
+	switch ctx.attr {
+	case attrJS:
+		s = ctx.js.escape(v)
+	case attrCSS:
+		s = escapeCSS(v.String())
+	case attrURL:
+		switch ctx.url {
+		case urlStart:
+			s = normalizeURL(filterURL(v.String()))
+		case urlPath:
+			s = normalizeURL(v.String())
+		default:
+			s = strings.Replace(url.QueryEscape(v.String()), "+", "%20", -1)
+		}
+	default:
+		if safe && ctx.state == stateAttr && ctx.delim != delimSpace {
+			return v.String()
+		}
+		s = v.String()
+	}
+	if ctx.state == stateBeforeValue || ctx.delim == delimSpace {
+		return escapeHTMLNospace(s)
+	}
+	return escapeHTML(s)
+}
+
+// escape returns v escaped for JavaScript in the state js. In code, v
+// becomes a JavaScript value; in a string, it becomes part of the string,
+// and likewise in a regular expression, where it matches itself. In a
+// comment it's escaped like in a string, so it can't end the comment.
+func (js jsState) escape(v Value) string {
+	switch js.mode {
+	case jsCode:
+	case jsRegexp, jsRegexpClass:
+		return escapeJSRegexp(v.String())
+	default:
+		return escapeJSString(v.String())
+	}
+	if _, ok := v.(nilValue); ok {
+		return " null "
+	}
+	switch v.Reflect().Kind() {
+	case reflect.Bool, reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr,
+		reflect.Float32, reflect.Float64:
+		// the spaces keep x-{{ -1 }} from becoming x--1
+		return " " + v.String() + " "
+	case reflect.String:
+		return `"` + escapeJSString(v.String()) + `"`
+	}
+	ref := goValue(v)
+	if ref.IsValid() && ref.CanInterface() {
+		// json.Marshal escapes <, > and & in strings, so the result can't
+		// end the script element
+		if b, err := json.Marshal(ref.Interface()); err == nil {
+			return " " + string(b) + " "
+		}
+	}
+	return `"` + escapeJSString(v.String()) + `"`
+}
+
+// escapeJSString escapes s for use in a JavaScript string literal in any
+// kind of quotes, within a script element or an HTML attribute.
+func escapeJSString(s string) string {
+	var buf strings.Builder
+	for _, r := range s {
+		switch r {
+		case '\\':
+			buf.WriteString(`\\`)
+		case '\n':
+			buf.WriteString(`\n`)
+		case '\r':
+			buf.WriteString(`\r`)
+		case '\t':
+			buf.WriteString(`\t`)
+		case '\'', '"', '`', '<', '>', '&', '=', '/', '$', '\u2028', '\u2029':
+			fmt.Fprintf(&buf, `\u%04X`, r)
+		default:
+			if r < ' ' {
+				fmt.Fprintf(&buf, `\u%04X`, r)
+			} else {
+				buf.WriteRune(r)
+			}
+		}
+	}
+	return buf.String()
+}
+
+// escapeJSRegexp escapes s for use in a JavaScript regular expression
+// literal, so that it matches s.
+func escapeJSRegexp(s string) string {
+	var buf strings.Builder
+	for _, r := range s {
+		if strings.ContainsRune(`.*+?^()[]{}|-`, r) {
+			buf.WriteByte('\\')
+			buf.WriteRune(r)
+		} else {
+			buf.WriteString(escapeJSString(string(r)))
+		}
+	}
+	return buf.String()
+}
+
+// escapeCSS escapes s for use in CSS, either as a value or within a quoted
+// string.
+func escapeCSS(s string) string {
+	var buf strings.Builder
+	for i, r := range s {
+		switch r {
+		case 0, '\t', '\n', '\f', '\r', '"', '&', '\'', '(', ')', '+', '/', ':', ';', '<', '>', '\\', '{', '}':
+			fmt.Fprintf(&buf, `\%x`, r)
+			// a hex digit or space after the escape would be taken as part
+			// of it, and what follows the value isn't known
+			rest := s[i+utf8.RuneLen(r):]
+			if next, _ := utf8.DecodeRuneInString(rest); rest == "" || isHexDigit(next) || next == ' ' {
+				buf.WriteByte(' ')
+			}
+		default:
+			buf.WriteRune(r)
+		}
+	}
+	return buf.String()
+}
+
+func isHexDigit(r rune) bool {
+	return '0' <= r && r <= '9' || 'a' <= r && r <= 'f' || 'A' <= r && r <= 'F'
+}
+
+// filterURL returns s unless it has a scheme other than http, https or
+// mailto, such as javascript, in which case it returns a harmless URL.
+func filterURL(s string) string {
+	if i := strings.IndexByte(s, ':'); i >= 0 && !strings.ContainsRune(s[:i], '/') {
+		switch strings.ToLower(s[:i]) {
+		case "http", "https", "mailto":
+		default:
+			return "#ZgotmplZ"
+		}
+	}
+	return s
+}
+
+// normalizeURL percent-encodes the bytes of s that can't appear in a URL,
+// leaving the rest, including existing escapes, alone.
+func normalizeURL(s string) string {
+	var buf strings.Builder
+	for i := 0; i < len(s); i++ {
+		b := s[i]
+		if isLetter(b) || '0' <= b && b <= '9' || strings.IndexByte("-._~!#$&'()*+,/:;=?@[]%", b) >= 0 {
+			buf.WriteByte(b)
+		} else {
+			fmt.Fprintf(&buf, "%%%02X", b)
+		}
+	}
+	return buf.String()
+}
+
+var htmlNospaceReplacer = strings.NewReplacer(
+	"&", "&amp;",
+	"<", "&lt;",
+	">", "&gt;",
+	"'", "&#39;",
+	`"`, "&quot;",
+	" ", "&#32;",
+	"\t", "&#9;",
+	"\n", "&#10;",
+	"\f", "&#12;",
+	"\r", "&#13;",
+	"=", "&#61;",
+	"`", "&#96;",
+)
+
+// escapeHTMLNospace escapes s for use in an unquoted attribute value.
+func escapeHTMLNospace(s string) string {
+	return htmlNospaceReplacer.Replace(s)
+}
@@ -0,0 +1,138 @@
+package template
+
+import (
+	"bytes"
+	"testing"
+)
+
+var contextualTests = []templateTest{
+	// text
+	{"<p>{{ s }}</p>", c{"s": "<b>"}, "<p>&lt;b&gt;</p>"},
+	{"<p>{{ s }}</p>", c{"s": SafeString("<b>")}, "<p><b></p>"},
+	{"<!-- {{ s }} -->", c{"s": "-->"}, "<!-- --&gt; -->"},
+	// attributes
+	{`<a title="{{ s }}">`, c{"s": `"x'`}, `<a title="&quot;x&#39;">`},
+	{`<a title='{{ s }}'>`, c{"s": SafeString("&amp;")}, `<a title='&amp;'>`},
+	{`<a title={{ s }}>`, c{"s": "x onclick=y"}, `<a title=x&#32;onclick&#61;y>`},
+	{`<a {{ s }}>`, c{"s": "x=1"}, `<a x&#61;1>`},
+	// URLs
+	{`<a href="{{ s }}">`, c{"s": "javascript:alert(1)"}, `<a href="#ZgotmplZ">`},
+	{`<a href="{{ s }}">`, c{"s": "https://example.com/a b"}, `<a href="https://example.com/a%20b">`},
+	{`<a href="/x?q={{ s }}">`, c{"s": "a&b=c d"}, `<a href="/x?q=a%26b%3Dc%20d">`},
+	{`<a href="/{{ s }}">`, c{"s": "javascript:x"}, `<a href="/javascript:x">`},
+	{`<img src={{ s }}>`, c{"s": "a'b"}, `<img src=a&#39;b>`},
+	{`<a href="{{ s }}">`, c{"s": SafeString("javascript:x")}, `<a href="#ZgotmplZ">`},
+	// JavaScript
+	{`<script>var x = {{ s }};</script>`, c{"s": "</script>"}, `<script>var x = "\u003C\u002Fscript\u003E";</script>`},
+	{`<script>var x = {{ n }};</script>`, c{"n": 1}, `<script>var x =  1 ;</script>`},
+	{`<script>var x = {{ l }};</script>`, c{"l": []int{1, 2}}, `<script>var x =  [1,2] ;</script>`},
+	{`<script>var x = {{ m }};</script>`, nil, `<script>var x =  null ;</script>`},
+	{`<script>var x = '{{ s }}';</script>`, c{"s": "'\n"}, `<script>var x = '\u0027\n';</script>`},
+	{`<script>var x = "\"{{ s }}";</script>`, c{"s": `"`}, `<script>var x = "\"\u0022";</script>`},
+	{`<SCRIPT type="text/javascript">'</Script>{{ s }}`, c{"s": "<b>"}, `<SCRIPT type="text/javascript">'</Script>&lt;b&gt;`},
+	{`<button onclick="f({{ s }})">`, c{"s": `"x"`}, `<button onclick="f(&quot;\u0022x\u0022&quot;)">`},
+	{`<button onclick="f('{{ s }}')">`, c{"s": "'"}, `<button onclick="f('\u0027')">`},
+	// JavaScript comments and regular expressions
+	{"<script>// don't\nvar a = {{ x }};</script>", c{"x": "alert(1)//"}, "<script>// don't\nvar a = \"alert(1)\\u002F\\u002F\";</script>"},
+	{"<script>/* it's */var a = {{ x }};</script>", c{"x": "alert(1)//"}, "<script>/* it's */var a = \"alert(1)\\u002F\\u002F\";</script>"},
+	{`<script>var r = /'/g; var a = {{ x }};</script>`, c{"x": "1"}, `<script>var r = /'/g; var a = "1";</script>`},
+	{`<script>var r = /[/']/; var a = {{ x }};</script>`, c{"x": "1"}, `<script>var r = /[/']/; var a = "1";</script>`},
+	{`<script>if (s) return /'/.test(s) ? {{ x }} : 0</script>`, c{"x": "1"}, `<script>if (s) return /'/.test(s) ? "1" : 0</script>`},
+	{`<script>var d = a / 2, b = '{{ x }}';</script>`, c{"x": "'"}, `<script>var d = a / 2, b = '\u0027';</script>`},
+	{`<script>var d = f(a) / 2 / b; var c = {{ x }};</script>`, c{"x": "'"}, `<script>var d = f(a) / 2 / b; var c = "\u0027";</script>`},
+	{"<script>// {{ x }}\n</script>", c{"x": "\nalert(1)"}, "<script>// \\nalert(1)\n</script>"},
+	{"<script>/* {{ x }} */</script>", c{"x": "*/alert(1)"}, `<script>/* *\u002Falert(1) */</script>`},
+	{`<script>var r = /{{ x }}/;</script>`, c{"x": "a.b/"}, `<script>var r = /a\.b\u002F/;</script>`},
+	{`<button onclick="/* it's */ f({{ x }})">`, c{"x": "x"}, `<button onclick="/* it's */ f(&quot;x&quot;)">`},
+	// CSS
+	{`<style>p { color: {{ s }} }</style>`, c{"s": "red}"}, `<style>p { color: red\7d  }</style>`},
+	{`<p style="color: {{ s }}">`, c{"s": "red;x:1"}, `<p style="color: red\3bx\3a 1">`},
+	// after the element, back to text
+	{`<style>p {}</style>{{ s }}`, c{"s": "<"}, `<style>p {}</style>&lt;`},
+	{`<p title="a" data-x=y>{{ s }}`, c{"s": "<"}, `<p title="a" data-x=y>&lt;`},
+	// other tags follow the context too
+	{`<a href="{% cycle s %}">{% firstof s %}`, c{"s": "javascript:x"}, `<a href="#ZgotmplZ">javascript:x`},
+	{`<a href="{% if s %}{{ s }}{% endif %}">{{ s }}`, c{"s": "javascript:x"}, `<a href="#ZgotmplZ">javascript:x`},
+	{`{% autoescape off %}<a href="{{ s }}">{% endautoescape %}`, c{"s": "javascript:x"}, `<a href="javascript:x">`},
+	// branches
+	{`<input {% if b %}checked{% endif %} value="{{ s }}">`, c{"b": true, "s": `"`}, `<input checked value="&quot;">`},
+	{`<script>var a = [{% for x in l %}{{ x }},{% endfor %}], b = {{ s }};</script>`, c{"l": []int{1}, "s": "x"},
+		`<script>var a = [ 1 ,], b = "x";</script>`},
+	{`<a href="/x?{% if b %}p=1&{% endif %}q={{ s }}">`, c{"s": "&"}, `<a href="/x?q=%26">`},
+	// blocks and includes
+	{`{% extends 'base' %}{% block u %}{{ s }}{% endblock %}`, c{"s": "javascript:x"}, `<a href="#ZgotmplZ">`},
+	{`{% extends 'base' %}{% override u %}{{ s }}{% endoverride %}{% endextends %}`, c{"s": "javascript:x"}, `<a href="#ZgotmplZ">`},
+	{`{% extends 'section' %}{% block u %}{{ s }}{% endblock %}`, c{"s": "javascript:x"}, `<a href="#ZgotmplZ"><b>`},
+	{`{% extends name %}{% block t %}{{ s }}{% endblock %}`, c{"name": "base", "s": "<"}, `<a href="">&lt;`},
+	{`<p>{% include 'script' %}</p>`, c{"s": "<"}, `<p><script>var s = "\u003C";</script></p>`},
+}
+
+func contextualEnv(opt ...string) *Environment {
+	env := NewEnvironment().Option("autoescape=on").Option(opt...)
+	env.SetLoader(NewMapLoader(env, map[string]string{
+		"base":    `<a href="{% block u %}{% endblock %}">{% block t %}{% endblock %}`,
+		"section": `{% extends 'base' %}{% block t %}<b>{% endblock %}`,
+		"script":  `<script>var s = {{ s }};</script>`,
+		"open":    `<a title="`,
+	}))
+	return env
+}
+
+func TestContextualEscape(t *testing.T) {
+	testEnv(t, contextualEnv("escape=contextual"), contextualTests)
+}
+
+func TestContextualErrors(t *testing.T) {
+	tests := []struct {
+		template string
+		err      string
+	}{
+		{`{% if b %}<a href="{% endif %}">`, "1:29: the branches of the if tag end in different HTML contexts"},
+		{`{% if b %}<a href="{% elif 1 %}<p>{% endif %}">`, "1:44: the branches of the if tag end in different HTML contexts"},
+		{`{% for x in l %}<script>{% endfor %}`, "1:35: the branches of the for tag end in different HTML contexts"},
+		{`<a href="{% if b %}/x{% endif %}{{ s }}">`, "1:40: value in an ambiguous part of a URL"},
+		{`<a href="{% include 'script' %}">`, "1:30: include tag outside of HTML text"},
+		{`{% include 'open' %}`, `1:19: include tag's template "open" doesn't end in HTML text`},
+		{`{% extends 'base' %}{% block u %}{{ s }}">{% endblock %}`, `1:55: block "u" ends in a different HTML context than the block it replaces`},
+	}
+	for i, test := range tests {
+		if _, err := contextualEnv("escape=contextual").ParseString(test.template); err == nil || err.Error() != test.err {
+			t.Errorf("#%d got error %v want %s", i, err, test.err)
+		}
+		// without the option, the error is reported only when the template
+		// is executed with it
+		temp, err := contextualEnv().ParseString(test.template)
+		if err != nil {
+			t.Errorf("#%d failed to parse: %s", i, err)
+			continue
+		}
+		var buf bytes.Buffer
+		err = temp.Option("escape=contextual").Execute(&buf, c{"b": true, "l": []int{1}})
+		if _, ok := err.(*ExecError); !ok || err.Error() != test.err {
+			t.Errorf("#%d got execution error %v want %s", i, err, test.err)
+		}
+	}
+}
+
+func TestContextualExecErrors(t *testing.T) {
+	// templates loaded while rendering can only be checked then
+	tests := []struct {
+		template string
+		err      string
+	}{
+		{`{% extends name %}{% block u %}{{ s }}{% endblock %}`, `base:1:19: block "u" is replaced by a version in a different HTML context`},
+		{`{% include other %}`, `1:12: include "open": template doesn't end in HTML text`},
+	}
+	for i, test := range tests {
+		temp, err := contextualEnv("escape=contextual").ParseString(test.template)
+		if err != nil {
+			t.Errorf("#%d failed to parse: %s", i, err)
+			continue
+		}
+		var buf bytes.Buffer
+		err = temp.Execute(&buf, c{"name": "base", "other": "open", "s": "javascript:x"})
+		if _, ok := err.(*ExecError); !ok || err.Error() != test.err {
+			t.Errorf("#%d got error %v want %s", i, err, test.err)
+		}
+	}
+}
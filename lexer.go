@@ -40,10 +40,14 @@ const (
 	TokGreater   // >
 	TokGreaterEq // >=
 	TokNotEq     // !=
+	TokIn        // in
+	TokNotIn     // not in
 
-	TokDot   // .
-	TokBar   // |
-	TokColon // :
+	TokDot    // .
+	TokBar    // |
+	TokColon  // :
+	TokLBrack // [
+	TokRBrack // ]
 )
 
 var tokStrings = map[Token]string{
@@ -72,9 +76,13 @@ var tokStrings = map[Token]string{
 	TokGreater:   ">",
 	TokGreaterEq: ">=",
 	TokNotEq:     "!=",
+	TokIn:        "in",
+	TokNotIn:     "not in",
 	TokDot:       ".",
 	TokBar:       "|",
 	TokColon:     ":",
+	TokLBrack:    "[",
+	TokRBrack:    "]",
 }
 
 func (t Token) String() string {
@@ -87,7 +95,7 @@ func (t Token) Precedence() int {
 		return 1
 	case TokAnd:
 		return 2
-	case TokEqual, TokNotEq, TokLess, TokLessEq, TokGreater, TokGreaterEq:
+	case TokEqual, TokNotEq, TokLess, TokLessEq, TokGreater, TokGreaterEq, TokIn, TokNotIn:
 		return 3
 	case TokAdd, TokSub:
 		return 4
@@ -103,6 +111,9 @@ type lexer struct {
 	ch        rune
 	width     int
 	insideTag bool
+	// err describes why the last TokIllegal was returned, if the reason is
+	// more specific than an unexpected character.
+	err string
 }
 
 func (l *lexer) init() {
@@ -124,11 +135,13 @@ func (l *lexer) next() {
 	}
 }
 
-func (l *lexer) scan() (Token, []byte) {
+// scan returns the offset of the next token, the token, and its literal text.
+func (l *lexer) scan() (int, Token, []byte) {
 scanAgain:
 	if !l.insideTag && l.ch != '{' {
+		pos := l.offset
 		lit := l.scanText()
-		return TokText, lit
+		return pos, TokText, lit
 	}
 	l.insideTag = true
 	l.consumeWhitespace()
@@ -138,7 +151,8 @@ scanAgain:
 
 	switch ch := l.ch; {
 	case unicode.IsLetter(ch), l.ch == '_':
-		return l.scanIdent()
+		tok, lit := l.scanIdent()
+		return pos, tok, lit
 	case unicode.IsDigit(ch):
 		tok = l.scanNumber()
 	case ch == '|':
@@ -150,6 +164,12 @@ scanAgain:
 	case ch == ':':
 		tok = TokColon
 		l.next()
+	case ch == '[':
+		tok = TokLBrack
+		l.next()
+	case ch == ']':
+		tok = TokRBrack
+		l.next()
 	case ch == '+':
 		tok = TokAdd
 		l.next()
@@ -179,15 +199,20 @@ scanAgain:
 				// start of a comment; scan until the end
 				l.next()
 				for {
-					for l.ch != '#' {
+					for l.ch != '#' && l.ch != -1 {
 						l.next()
 					}
+					if l.ch == -1 {
+						l.err = "unterminated comment"
+						return pos, TokIllegal, l.src[pos:]
+					}
 					l.next()
 					if l.ch == '}' {
 						l.next()
 						break
 					}
 				}
+				l.insideTag = false
 				goto scanAgain
 			}
 		case '%':
@@ -205,7 +230,10 @@ scanAgain:
 			}
 		case '\'', '"':
 			tok = l.scanString(byte(ch))
-			return tok, l.src[pos+1 : l.offset-1]
+			if tok != TokString {
+				return pos, tok, l.src[pos:]
+			}
+			return pos, tok, l.src[pos+1 : l.offset-1]
 		case '<':
 			tok = TokLess
 			if l.ch == '=' {
@@ -230,7 +258,7 @@ scanAgain:
 			}
 		}
 	}
-	return tok, l.src[pos:l.offset]
+	return pos, tok, l.src[pos:l.offset]
 }
 
 func (l *lexer) consumeWhitespace() {
@@ -287,12 +315,38 @@ func (l *lexer) scanIdent() (Token, []byte) {
 		tok = TokAnd
 	case "or":
 		tok = TokOr
+	case "in":
+		tok = TokIn
 	case "not":
 		tok = TokNot
+		if l.scanIn() {
+			tok = TokNotIn
+			lit = l.src[pos:l.offset]
+		}
 	}
 	return tok, lit
 }
 
+// scanIn consumes whitespace followed by the word "in" and reports whether
+// it did. Otherwise nothing is consumed.
+func (l *lexer) scanIn() bool {
+	i := l.offset
+	for i < len(l.src) && (l.src[i] == ' ' || l.src[i] == '\t' || l.src[i] == '\n' || l.src[i] == '\r') {
+		i++
+	}
+	if i == l.offset || !bytes.HasPrefix(l.src[i:], []byte("in")) {
+		return false
+	}
+	i += len("in")
+	if r, _ := utf8.DecodeRune(l.src[i:]); unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_' {
+		return false
+	}
+	for l.offset < i {
+		l.next()
+	}
+	return true
+}
+
 func (l *lexer) scanNumber() Token {
 	tok := TokInt
 	seenDecimal := false
@@ -321,7 +375,11 @@ func (l *lexer) scanString(start byte) Token {
 	// ' or " already consumed
 	pos := bytes.IndexByte(l.src[l.offset:], start)
 	if pos < 0 {
-		panic("String not terminated")
+		l.err = "unterminated string"
+		l.offset = len(l.src)
+		l.width = 0
+		l.ch = -1
+		return TokIllegal
 	}
 	l.offset += pos
 	l.width = 1
@@ -0,0 +1,143 @@
+package template
+
+import (
+	"io/fs"
+	"os"
+	"sync/atomic"
+)
+
+// A Loader finds templates by name. An Environment uses its Loader to
+// resolve the names given to include and extends tags.
+type Loader interface {
+	// Load returns the template with the given name. If there's no such
+	// template, the error should wrap fs.ErrNotExist.
+	Load(name string) (*Template, error)
+}
+
+// A Reloader is a Loader that can tell when the source of a template it
+// loaded has changed. An Environment whose Loader is a Reloader in reload
+// mode checks templates for changes every time they're used and loads them
+// again if necessary, so edits show up without restarting the program.
+type Reloader interface {
+	Loader
+
+	// Reloading reports whether the Reloader is in reload mode.
+	Reloading() bool
+
+	// Changed reports whether the source of t, which was loaded with the
+	// given name, has changed since t was loaded.
+	Changed(name string, t *Template) bool
+}
+
+// An envLoader is a Loader that can parse templates with the Environment it
+// was set on.
+type envLoader interface {
+	loadIn(e *Environment, name string) (*Template, error)
+}
+
+// loadWith loads the named template with l, which was set on e.
+func loadWith(l Loader, e *Environment, name string) (*Template, error) {
+	if el, ok := l.(envLoader); ok {
+		return el.loadIn(e, name)
+	}
+	return l.Load(name)
+}
+
+// An FSLoader loads templates from the files in a file system, such as an
+// embed.FS. Template names are slash-separated paths within the file system.
+//
+// An FSLoader is a Reloader that uses the files' modification times to
+// detect changes. Reload mode is off by default.
+type FSLoader struct {
+	env    *Environment
+	fsys   fs.FS
+	reload atomic.Bool
+}
+
+// NewFSLoader returns a Loader that reads templates from fsys and parses
+// them with env. If env is nil, templates are parsed with the Environment
+// the Loader is set on, or with the default Environment when Load is called
+// directly.
+func NewFSLoader(env *Environment, fsys fs.FS) *FSLoader {
+	return &FSLoader{env: env, fsys: fsys}
+}
+
+// NewDirLoader returns a Loader that reads templates from the directory dir
+// and parses them with env, which may be nil as for NewFSLoader.
+// Template names are slash-separated paths relative to dir, so templates
+// are found no matter what the working directory is.
+func NewDirLoader(env *Environment, dir string) *FSLoader {
+	return NewFSLoader(env, os.DirFS(dir))
+}
+
+func (l *FSLoader) Load(name string) (*Template, error) {
+	return l.loadIn(defaultEnv, name)
+}
+
+func (l *FSLoader) loadIn(e *Environment, name string) (*Template, error) {
+	if l.env != nil {
+		e = l.env
+	}
+	// stat before reading so that a change made in between is noticed
+	fi, err := fs.Stat(l.fsys, name)
+	if err != nil {
+		return nil, err
+	}
+	b, err := fs.ReadFile(l.fsys, name)
+	if err != nil {
+		return nil, err
+	}
+	t, err := e.parse(name, b)
+	if err != nil {
+		return nil, err
+	}
+	t.modTime = fi.ModTime()
+	return t, nil
+}
+
+// SetReload turns reload mode on or off. Reload mode is meant for
+// development; it costs a stat call each time a template is used.
+func (l *FSLoader) SetReload(on bool) {
+	l.reload.Store(on)
+}
+
+func (l *FSLoader) Reloading() bool {
+	return l.reload.Load()
+}
+
+func (l *FSLoader) Changed(name string, t *Template) bool {
+	fi, err := fs.Stat(l.fsys, name)
+	if err != nil {
+		// report the error by loading the template again
+		return true
+	}
+	return !fi.ModTime().Equal(t.modTime)
+}
+
+// A MapLoader loads templates from source held in memory.
+type MapLoader struct {
+	env *Environment
+	src map[string]string
+}
+
+// NewMapLoader returns a Loader that parses the source src[name] with env,
+// which may be nil as for NewFSLoader. The map must not be modified while
+// the Loader is in use.
+func NewMapLoader(env *Environment, src map[string]string) *MapLoader {
+	return &MapLoader{env, src}
+}
+
+func (l *MapLoader) Load(name string) (*Template, error) {
+	return l.loadIn(defaultEnv, name)
+}
+
+func (l *MapLoader) loadIn(e *Environment, name string) (*Template, error) {
+	if l.env != nil {
+		e = l.env
+	}
+	s, ok := l.src[name]
+	if !ok {
+		return nil, &fs.PathError{Op: "load", Path: name, Err: fs.ErrNotExist}
+	}
+	return e.parse(name, []byte(s))
+}
@@ -0,0 +1,289 @@
+package template
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+var loaderTests = []templateTest{
+	{"{% include 'hello' %}", c{"name": "world"}, "hello world"},
+	{"{% include 'nested/outer' %}", c{"name": "world"}, "[hello world]"},
+	{"{% include var %}", c{"var": "hello", "name": "you"}, "hello you"},
+	{"{% extends 'parent' %}{% override title %}child title{% endoverride %}{% endextends %}", c{}, "parent start child title\n"},
+}
+
+func TestMapLoader(t *testing.T) {
+	env := NewEnvironment()
+	env.SetLoader(NewMapLoader(env, map[string]string{
+		"hello":        "hello {{ name }}",
+		"nested/outer": "[{% include 'hello' %}]",
+		"parent":       "parent start {% block title %}parent title{% endblock %}\n",
+	}))
+	testEnv(t, env, loaderTests)
+}
+
+func TestFSLoader(t *testing.T) {
+	env := NewEnvironment()
+	env.SetLoader(NewFSLoader(env, fstest.MapFS{
+		"hello":        {Data: []byte("hello {{ name }}")},
+		"nested/outer": {Data: []byte("[{% include 'hello' %}]")},
+		"parent":       {Data: []byte("parent start {% block title %}parent title{% endblock %}\n")},
+	}))
+	testEnv(t, env, loaderTests)
+}
+
+func TestDirLoader(t *testing.T) {
+	env := NewEnvironment()
+	env.SetLoader(NewDirLoader(env, "testdata"))
+	testEnv(t, env, []templateTest{
+		{"{% extends 'parent' %}{% override title %}child title{% endoverride %}{% endextends %}", c{}, "parent start child title\n"},
+	})
+	temp, err := env.Load("parent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if temp.Name() != "parent" || temp.Environment() != env {
+		t.Errorf("got name %q, environment %p", temp.Name(), temp.Environment())
+	}
+}
+
+func TestLoaderNilEnv(t *testing.T) {
+	src := map[string]string{
+		"outer": "[{% include 'inner' %}]",
+		"inner": "{{ name|shout }}",
+	}
+	fsys := fstest.MapFS{}
+	for name, s := range src {
+		fsys[name] = &fstest.MapFile{Data: []byte(s)}
+	}
+	shout := func(in Expr, c *Context, arg Expr) Value {
+		return stringValue(in.Eval(c).String() + "!")
+	}
+	for _, l := range []Loader{NewMapLoader(nil, src), NewFSLoader(nil, fsys)} {
+		env := NewEnvironment()
+		env.RegisterFilter("shout", shout, NoArg)
+		env.SetLoader(l)
+		temp, err := env.Load("outer")
+		if err != nil {
+			t.Errorf("%T: %s", l, err)
+			continue
+		}
+		if temp.Environment() != env {
+			t.Errorf("%T: template not bound to the Environment", l)
+		}
+		var buf bytes.Buffer
+		if err := temp.Execute(&buf, c{"name": "hi"}); err != nil {
+			t.Errorf("%T: %s", l, err)
+		} else if buf.String() != "[hi!]" {
+			t.Errorf("%T: got %q", l, buf.String())
+		}
+	}
+}
+
+func TestExtendsChain(t *testing.T) {
+	env := NewEnvironment()
+	env.SetLoader(NewMapLoader(env, map[string]string{
+		"base": "<title>{% block title %}base{% endblock %}</title>" +
+			"{% block body %}[{% block content %}base content{% endblock %}]{% endblock %}",
+		"section": "{% extends 'base' %}ignored" +
+			"{% block title %}section{% endblock %}" +
+			"{% block content %}section content{% endblock content %}",
+		"page":   "{% extends 'section' %}{% block title %}{{ title }}{% endblock %}",
+		"nested": "{% extends 'section' %}{% block body %}<{% block content %}nested{% endblock %}>{% endblock %}",
+		"old":    "{% extends 'base' %}{% override title %}old{% endoverride %}{% endextends %}",
+		"super":  "{% extends 'section' %}{% block title %}{{ block.super }} + super{% endblock %}",
+	}))
+	testEnv(t, env, []templateTest{
+		{"{% extends 'base' %}", c{}, "<title>base</title>[base content]"},
+		{"{% extends 'section' %}", c{}, "<title>section</title>[section content]"},
+		{"{% extends 'page' %}", c{"title": "page"}, "<title>page</title>[section content]"},
+		{"{% extends 'page' %}{% block content %}{{ x }}{% endblock %}", c{"title": "page", "x": 1}, "<title>page</title>[1]"},
+		{"{% extends 'nested' %}", c{}, "<title>section</title><nested>"},
+		{"{% extends name %}{% block title %}dynamic{% endblock %}", c{"name": "section"}, "<title>dynamic</title>[section content]"},
+		{"{% extends 'old' %}", c{}, "<title>old</title>[base content]"},
+		{"{% extends 'super' %}", c{}, "<title>section + super</title>[section content]"},
+		{"{% extends 'super' %}{% block title %}{{ block.super|capfirst }}!{% endblock %}", c{}, "<title>Section + super!</title>[section content]"},
+		{"{% extends 'super' %}{% block title %}{{ block.super }} + page{% endblock %}", c{}, "<title>section + super + page</title>[section content]"},
+		{"{% extends 'super' %}{% block content %}{{ block.super }}, {{ block.super }}{% endblock %}", c{},
+			"<title>section + super</title>[section content, section content]"},
+		{"{% extends 'section' %}{% block body %}{% block content %}{{ block.super }}{% endblock %}{{ block.super }}{% endblock %}", c{},
+			"<title>section</title>section content[section content]"},
+		{"{% block title %}[{{ block.super }}]{% endblock %}", c{}, "[]"},
+		{"{% include 'page' %}|{% include 'page' %}", c{"title": "a"}, "<title>a</title>[section content]|<title>a</title>[section content]"},
+	})
+}
+
+func TestLoaderNotExist(t *testing.T) {
+	for _, l := range []Loader{
+		NewMapLoader(nil, map[string]string{}),
+		NewFSLoader(nil, fstest.MapFS{}),
+		NewDirLoader(nil, "testdata"),
+	} {
+		env := NewEnvironment()
+		env.SetLoader(l)
+		temp, err := env.ParseString("{% include 'missing' %}")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		err = temp.Execute(&buf, nil)
+		if !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("%T: got error %v, want one wrapping fs.ErrNotExist", l, err)
+		}
+	}
+}
+
+// countingLoader counts how many times each template is loaded.
+type countingLoader struct {
+	Loader
+	mu    sync.Mutex
+	loads map[string]int
+}
+
+func (l *countingLoader) Load(name string) (*Template, error) {
+	l.mu.Lock()
+	l.loads[name]++
+	l.mu.Unlock()
+	return l.Loader.Load(name)
+}
+
+func TestLoaderCache(t *testing.T) {
+	env := NewEnvironment()
+	l := &countingLoader{loads: map[string]int{}}
+	l.Loader = NewMapLoader(env, map[string]string{
+		"page":    "{% include 'partial' %}{% include name %}",
+		"partial": "<{{ x }}>",
+		"other":   "[{{ x }}]",
+	})
+	env.SetLoader(l)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			page, err := env.Load("page")
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			for j := 0; j < 10; j++ {
+				var buf bytes.Buffer
+				if err := page.Execute(&buf, c{"x": 1, "name": "other"}); err != nil {
+					t.Error(err)
+				} else if buf.String() != "<1>[1]" {
+					t.Errorf("got %q", buf.String())
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	want := map[string]int{"page": 1, "partial": 1, "other": 1}
+	if !reflect.DeepEqual(l.loads, want) {
+		t.Errorf("got loads %v want %v", l.loads, want)
+	}
+
+	// the constant include was resolved while parsing
+	page, _ := env.Load("page")
+	if page.nodes[0].(includeTag).t == nil {
+		t.Error("include 'partial' wasn't resolved at parse time")
+	}
+}
+
+func TestLoaderCacheCycle(t *testing.T) {
+	env := NewEnvironment()
+	env.SetLoader(NewMapLoader(env, map[string]string{
+		"a": "a{% if more %}{% include 'b' %}{% endif %}",
+		"b": "b{% include 'a' %}",
+	}))
+	a, err := env.Load("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := a.Execute(&buf, nil); err != nil || buf.String() != "a" {
+		t.Errorf("got %q, %v", buf.String(), err)
+	}
+}
+
+func TestLoaderErrorsNotCached(t *testing.T) {
+	env := NewEnvironment()
+	src := map[string]string{"bad": "{% nosuchtag %}"}
+	l := &countingLoader{Loader: NewMapLoader(env, src), loads: map[string]int{}}
+	env.SetLoader(l)
+	for i := 0; i < 2; i++ {
+		if _, err := env.Load("bad"); err == nil {
+			t.Error("expected an error")
+		}
+	}
+	if l.loads["bad"] != 2 {
+		t.Errorf("got %d loads want 2", l.loads["bad"])
+	}
+}
+
+func TestReload(t *testing.T) {
+	dir := t.TempDir()
+	env := NewEnvironment()
+	l := NewDirLoader(env, dir)
+	env.SetLoader(l)
+
+	mtime := time.Now().Add(-time.Hour)
+	write := func(name, src string) {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(src), 0644); err != nil {
+			t.Fatal(err)
+		}
+		// make sure each write has a distinct modification time
+		mtime = mtime.Add(time.Second)
+		if err := os.Chtimes(path, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	render := func(want string) {
+		t.Helper()
+		page, err := env.Load("page")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		if err := page.Execute(&buf, c{"x": 1}); err != nil {
+			t.Fatal(err)
+		}
+		if buf.String() != want {
+			t.Errorf("got %q want %q", buf.String(), want)
+		}
+	}
+	write("page", "page {% include 'partial' %}")
+	write("partial", "one {{ x }}")
+	render("page one 1")
+
+	// without reload mode, changes are ignored
+	write("partial", "two {{ x }}")
+	render("page one 1")
+
+	l.SetReload(true)
+	render("page two 1")
+	write("page", "new page {% include 'partial' %}")
+	render("new page two 1")
+
+	// a broken template is reported, but the last good version is kept
+	write("partial", "{% oops %}")
+	if _, err := env.Load("partial"); err == nil {
+		t.Error("expected a parse error")
+	}
+	page, _ := env.Load("page")
+	if err := page.Execute(io.Discard, nil); err == nil {
+		t.Error("expected an error rendering the including template")
+	}
+	l.SetReload(false)
+	render("new page two 1")
+}
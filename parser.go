@@ -1,34 +1,172 @@
 package template
 
 import (
+	"errors"
 	"fmt"
-	"io/ioutil"
+	"reflect"
 	"strconv"
 )
 
+// A Parser turns template source into Nodes. Tags registered with
+// RegisterTag receive the Parser positioned after the tag's name and use its
+// methods to parse the rest of the tag.
 type Parser struct {
-	l   *lexer
-	tok Token
-	lit []byte
-	s   *scope
+	name    string
+	l       *lexer
+	pos     int
+	tok     Token
+	lit     []byte
+	s       *Scope
+	env     *Environment
+	tags    map[string]TagFunc
+	filters map[string]*regFilter
+
+	// blocks holds the block tags parsed so far and blockNames their names.
+	blocks     []*blockTag
+	blockNames map[string]bool
+	// atEnd is set by a tag that covers the rest of the template.
+	atEnd bool
+	// ntags counts the tags and variables parsed so far.
+	ntags int
+	// esc is set by the autoescape tag.
+	esc escMode
+	// html is the HTML context at the current token.
+	html htmlContext
+	// paths is as in Template.
+	paths []string
+	// parentCtx holds the contexts of the blocks of the template being
+	// extended, if it was loaded while parsing.
+	parentCtx map[string]blockContext
+	// htmlErrors holds the errors found in tracking the HTML context.
+	htmlErrors ErrorList
+	// typ is the type of the data for ParseTyped, or nil.
+	typ reflect.Type
+
+	errors ErrorList
 }
 
+// Error stops parsing the current tag and reports a *ParseError at the
+// current token. Parsing resumes after the end of the tag so that further
+// errors can be found; all of them are returned from Parse.
 func (p *Parser) Error(format string, args ...interface{}) {
-	panic(fmt.Sprintf(format, args...))
+	panic(p.newError(fmt.Sprintf(format, args...)))
+}
+
+// htmlError records an error in tracking the HTML context at the current
+// token. With the escape=contextual option, it's a parse error; otherwise
+// it's reported if the template is executed with that option.
+func (p *Parser) htmlError(format string, args ...interface{}) {
+	p.htmlErrors = append(p.htmlErrors, p.newError(fmt.Sprintf(format, args...)))
+}
+
+// joinHTML sets the context after a tag with branches, one of which ended
+// in ctx and the other in the current context.
+func (p *Parser) joinHTML(tag string, ctx htmlContext) {
+	var ok bool
+	if p.html, ok = join(ctx, p.html); !ok {
+		p.htmlError("the branches of the %s tag end in different HTML contexts", tag)
+	}
+}
+
+func (p *Parser) newError(msg string) *ParseError {
+	return &ParseError{
+		Position: p.Pos(),
+		Tok:      p.tok,
+		Lit:      string(p.lit),
+		Msg:      msg,
+		Excerpt:  excerpt(p.l.src, p.pos),
+	}
+}
+
+// recover turns a panic raised by Error into an error stored in errp.
+// Any other panic is a bug and is passed on.
+func (p *Parser) recover(errp *error) {
+	if e := recover(); e != nil {
+		err, ok := e.(*ParseError)
+		if !ok {
+			panic(e)
+		}
+		p.errors = append(p.errors, err)
+		*errp = p.errors
+	}
+}
+
+// parseTag calls parse to parse a tag. If parse fails, the error is recorded,
+// the rest of the tag is skipped, and parseTag returns nil.
+func (p *Parser) parseTag(parse func() Node) (n Node) {
+	defer p.recoverTag()
+	return parse()
+}
+
+func (p *Parser) recoverTag() {
+	e := recover()
+	if e == nil {
+		return
+	}
+	err, ok := e.(*ParseError)
+	if !ok {
+		panic(e)
+	}
+	p.errors = append(p.errors, err)
+	p.skipTag()
 }
 
-func (p *Parser) Scope() *scope {
+// skipTag advances past the end of the current tag.
+func (p *Parser) skipTag() {
+	for {
+		switch p.tok {
+		case TokEof:
+			return
+		case TokTagEnd, TokVarEnd:
+			p.scan()
+			return
+		}
+		p.scan()
+	}
+}
+
+// scan is like Next, but records lexer errors instead of stopping.
+func (p *Parser) scan() {
+	p.pos, p.tok, p.lit = p.l.scan()
+	if p.tok == TokIllegal && p.l.err != "" {
+		p.errors = append(p.errors, p.newError(p.l.err))
+		p.l.err = ""
+	}
+}
+
+// Pos returns the Position of the current token.
+func (p *Parser) Pos() Position {
+	return position(p.name, p.l.src, p.pos)
+}
+
+// Scope returns the Scope used to allocate the template's Variables.
+func (p *Parser) Scope() *Scope {
 	return p.s
 }
 
+// Current returns the current token.
 func (p *Parser) Current() Token {
 	return p.tok
 }
 
+// Lit returns the literal text of the current token. For strings, the
+// quotes are not included.
+func (p *Parser) Lit() string {
+	return string(p.lit)
+}
+
+// Next advances to the next token.
 func (p *Parser) Next() {
-	p.tok, p.lit = p.l.scan()
+	p.pos, p.tok, p.lit = p.l.scan()
+	if p.tok == TokIllegal && p.l.err != "" {
+		msg := p.l.err
+		p.l.err = ""
+		p.Error("%s", msg)
+	}
 }
 
+// Expect reports an error if the current token isn't tok. Otherwise it
+// advances to the next token and returns the literal text of tok.
 func (p *Parser) Expect(tok Token) string {
 	if p.tok != tok {
 		p.Error("expected %s, got %s", tok, p.tok)
@@ -38,19 +176,30 @@ func (p *Parser) Expect(tok Token) string {
 	return string(lit)
 }
 
+// ExpectWord reports an error unless the current token is the identifier or
+// keyword word, then advances to the next token.
 func (p *Parser) ExpectWord(word string) {
-	if p.tok != TokIdent || string(p.lit) != word {
-		p.Error("expected ident %s, got Token %s, %s", word, p.tok, p.lit)
+	switch p.tok {
+	case TokIdent, TokAnd, TokOr, TokNot, TokIn:
+		if string(p.lit) == word {
+			p.Next()
+			return
+		}
 	}
-	p.Next()
+	p.Error("expected ident %s, got Token %s, %s", word, p.tok, p.lit)
 }
 
-// parse until one of the following tags
+// ParseUntil parses the template until it finds a tag named by one of tags
+// or reaches the end of the source. It returns the name of the tag found, or
+// "" at the end of the source, and the nodes parsed before it. The Parser is
+// left positioned after the tag name, so the caller must consume the rest of
+// the tag, typically with Expect(TokTagEnd).
 func (p *Parser) ParseUntil(tags ...string) (string, NodeList) {
 	r := make(NodeList, 0, 10)
 	for p.tok != TokEof {
 		switch p.tok {
 		case TokText:
+			p.html = p.html.next(p.lit)
 			r = append(r, printLit(p.lit))
 			p.Next()
 		case TokTagStart:
@@ -62,33 +211,77 @@ func (p *Parser) ParseUntil(tags ...string) (string, NodeList) {
 					return t, r
 				}
 			}
-			r = append(r, p.parseBlockTag())
+			p.ntags++
+			if n := p.parseTag(p.parseBlockTag); n != nil {
+				r = append(r, n)
+			}
 		case TokVarStart:
-			r = append(r, p.parseVarTag())
+			p.ntags++
+			if n := p.parseTag(p.parseVarTag); n != nil {
+				r = append(r, n)
+			}
 		default:
-			p.Error("unexpected Token %s", p.tok)
+			p.Error("unexpected %s %q", p.tok, p.lit)
 		}
 	}
 	return "", r
 }
 
 func (p *Parser) parseBlockTag() Node {
-	if tag, ok := tags[p.Expect(TokIdent)]; ok {
-		node := tag(p)
-		p.Expect(TokTagEnd)
+	if p.tok != TokIdent {
+		p.Expect(TokIdent)
+	}
+	tag, ok := p.tags[string(p.lit)]
+	if !ok {
+		p.Error("unknown tag %q", p.lit)
+	}
+	p.Next()
+	node := tag(p)
+	if p.atEnd && p.tok == TokEof {
 		return node
 	}
-	p.Error("tag isn't registered")
-	return nil
+	p.Expect(TokTagEnd)
+	return node
 }
 
 func (p *Parser) parseVarTag() Node {
 	p.Expect(TokVarStart)
 	e := p.ParseExpr()
 	p.Expect(TokVarEnd)
-	return varTag{e}
+	return varTag{e, p.escaping()}
 }
 
+// escaping returns how a value printed at the current token is escaped,
+// and moves the HTML context past the value.
+func (p *Parser) escaping() escaping {
+	if p.html.state == stateAttr && p.html.attr == attrURL && p.html.url == urlUnknown {
+		p.htmlError("value in an ambiguous part of a URL")
+	}
+	esc := escaping{p.esc, p.html}
+	p.html = p.html.afterValue()
+	return esc
+}
+
+// preload returns the template named by e if e is a constant string and the
+// template can be loaded right away. Otherwise it returns nil and the
+// template is loaded at render time, which is also when errors are reported.
+func (p *Parser) preload(e Expr) *Template {
+	ce, ok := e.(constExpr)
+	if !ok {
+		return nil
+	}
+	name, ok := ce.v.(stringValue)
+	if !ok {
+		return nil
+	}
+	t, _, err := p.env.load(string(name), false)
+	if err != nil {
+		return nil
+	}
+	return t
+}
+
+// ParseExpr parses an expression, including any filters applied to it.
 func (p *Parser) ParseExpr() Expr {
 	e := p.parseBinaryExpr(1)
 	if f := p.parseFilters(); len(f) > 0 {
@@ -120,32 +313,68 @@ func (p *Parser) parseOperand() Expr {
 	case TokIdent:
 		ret = p.parseVar()
 	default:
-		p.Error("unexpected Token %s", p.tok)
+		p.Error("unexpected %s %q", p.tok, p.lit)
 	}
 	return ret
 }
 
 func (p *Parser) parsePrimaryExpr() Expr {
 	x := p.parseOperand()
+	root, free := x.(*varExpr)
+	free = free && p.s.isFree(root.name, root.v)
 L:
 	for {
 		switch p.tok {
 		case TokDot:
 			p.Next()
 			attr := string(p.lit)
+			pos := p.Pos()
 			if p.tok == TokInt {
 				p.Next()
 			} else {
 				p.Expect(TokIdent)
 			}
-			x = &attrExpr{x, attr}
+			x = &attrExpr{x, attr, pos}
+		case TokLBrack:
+			// the path only goes as far as the first subscript
+			if _, ok := x.(*attrExpr); ok && free {
+				p.paths = append(p.paths, exprPath(x))
+			}
+			free = false
+			x = p.parseSubscript(x)
 		default:
 			break L
 		}
 	}
+	if _, ok := x.(*attrExpr); ok && free {
+		p.paths = append(p.paths, exprPath(x))
+	}
+	p.typeOf(x)
 	return x
 }
 
+// parseSubscript parses a subscript of x, either an index or a slice:
+//
+//	x[i]  x[low:high]  x[low:]  x[:high]
+func (p *Parser) parseSubscript(x Expr) Expr {
+	pos := p.Pos()
+	p.Expect(TokLBrack)
+	var low, high Expr
+	if p.tok != TokColon {
+		low = p.ParseExpr()
+	}
+	if p.tok != TokColon {
+		p.Expect(TokRBrack)
+		return &indexExpr{x, low, pos}
+	}
+	p.Next()
+	if p.tok != TokRBrack {
+		high = p.ParseExpr()
+	}
+	p.Expect(TokRBrack)
+	return &sliceExpr{x, low, high, pos}
+}
+
 func (p *Parser) parseUnaryExpr() Expr {
 	switch p.tok {
 	case TokAdd, TokSub, TokNot:
@@ -157,32 +386,49 @@ func (p *Parser) parseUnaryExpr() Expr {
 	return p.parsePrimaryExpr()
 }
 
+// notPrec is the precedence of the operand of not, which like in Python
+// binds more loosely than comparisons, so not x in l is not (x in l).
+const notPrec = 3
+
 func (p *Parser) parseBinaryExpr(prec1 int) Expr {
-	x := p.parseUnaryExpr()
+	var x Expr
+	if p.tok == TokNot && prec1 <= notPrec {
+		p.Next()
+		x = &unaryExpr{TokNot, p.parseBinaryExpr(notPrec)}
+	} else {
+		x = p.parseUnaryExpr()
+	}
 	for prec := p.tok.Precedence(); prec >= prec1; prec-- {
 		for p.tok.Precedence() == prec {
-			op := p.tok
+			op, pos := p.tok, p.Pos()
 			p.Next()
 			y := p.parseBinaryExpr(prec + 1)
-			x = &binaryExpr{op, x, y}
+			x = &binaryExpr{op, x, y, pos}
 		}
 	}
 	return x
 }
 
-func (p *Parser) parseVar() Variable {
-	return p.s.Lookup(p.Expect(TokIdent))
+func (p *Parser) parseVar() Expr {
+	pos := p.Pos()
+	name := p.Expect(TokIdent)
+	return &varExpr{p.s.Lookup(name), name, pos}
 }
 
 func (p *Parser) parseFilters() []*filter {
 	var f []*filter
 	for p.tok == TokBar {
 		p.Next()
-		rf, ok := filters[string(p.lit)]
+		if p.tok != TokIdent {
+			p.Expect(TokIdent)
+		}
+		name := string(p.lit)
+		pos := p.Pos()
+		rf, ok := p.filters[name]
 		if !ok {
-			p.Error("filter does not exist")
+			p.Error("unknown filter %q", name)
 		}
-		p.Expect(TokIdent)
+		p.Next()
 		var val Expr
 		args := false
 		switch rf.arg {
@@ -192,28 +438,62 @@ func (p *Parser) parseFilters() []*filter {
 			args = p.tok == TokColon
 		case NoArg:
 			if p.tok == TokColon {
-				p.Error("filter accepts no arguments")
+				p.Error("filter %q accepts no arguments", name)
 			}
 		}
+		if rf.arg == ReqArg && p.tok != TokColon {
+			p.Error("filter %q requires an argument", name)
+		}
 		if args {
 			p.Expect(TokColon)
 			val = p.ParseExpr()
 		}
-		f = append(f, &filter{rf.f, val})
+		f = append(f, &filter{name, pos, rf.f, val})
 	}
 	return f
 }
 
+// Parse parses a template from s using the default Environment. If the
+// template is malformed, the returned error is an ErrorList describing every
+// problem found.
 func Parse(s []byte) (*Template, error) {
-	t := new(Template)
+	return defaultEnv.Parse(s)
+}
+
+func (e *Environment) parse(name string, s []byte) (*Template, error) {
+	return e.parseTyped(name, s, nil)
+}
+
+func (e *Environment) parseTyped(name string, s []byte, typ reflect.Type) (t *Template, err error) {
 	l := &lexer{src: s}
 	l.init()
-	p := &Parser{l: l, s: newScope()}
+	tags, filters, opts := e.snapshot()
+	p := &Parser{name: name, l: l, s: newScope(), env: e, tags: tags, filters: filters,
+		blockNames: map[string]bool{}, typ: typ}
+	defer p.recover(&err)
 
 	p.Next()
-	_, t.nodes = p.ParseUntil()
-	t.scope = p.s
-
+	_, nodes := p.ParseUntil()
+	if opts.contextual {
+		p.errors = append(p.errors, p.htmlErrors...)
+	}
+	if len(p.errors) > 0 {
+		return nil, p.errors
+	}
+	contexts := make(map[string]blockContext, len(p.parentCtx)+len(p.blocks))
+	for name, ctx := range p.parentCtx {
+		contexts[name] = ctx
+	}
+	for _, b := range p.blocks {
+		contexts[b.name] = b.ctx
+	}
+	t = &Template{name: name, env: e, scope: p.s, nodes: nodes, opts: opts,
+		blocks: p.blocks, paths: p.paths, contexts: contexts, end: p.html}
+	if len(p.htmlErrors) > 0 {
+		// reported if the template is executed with escape=contextual
+		perr := p.htmlErrors[0]
+		t.htmlErr = &ExecError{perr.Position, errors.New(perr.Msg)}
+	}
 	return t, nil
 }
 
@@ -225,8 +505,9 @@ func MustParse(s []byte) *Template {
 	return t
 }
 
+// ParseString is like Parse but takes a string.
 func ParseString(s string) (*Template, error) {
-	return Parse([]byte(s))
+	return defaultEnv.ParseString(s)
 }
 
 func MustParseString(s string) *Template {
@@ -237,10 +518,8 @@ func MustParseString(s string) *Template {
 	return t
 }
 
+// ParseFile parses the named file using the default Environment. The file
+// name becomes the template's name.
 func ParseFile(name string) (*Template, error) {
-	b, err := ioutil.ReadFile(name)
-	if err != nil {
-		return nil, err
-	}
-	return Parse(b)
+	return defaultEnv.ParseFile(name)
 }
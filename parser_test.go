@@ -0,0 +1,102 @@
+package template
+
+import (
+	"errors"
+	"testing"
+)
+
+type parseErrorTest struct {
+	template string
+	line     int
+	column   int
+	msg      string
+}
+
+var parseErrorTests = []parseErrorTest{
+	{"{% nosuchtag %}", 1, 4, `unknown tag "nosuchtag"`},
+	{"hello\n  {{ var|nosuchfilter }}", 2, 10, `unknown filter "nosuchfilter"`},
+	{"{{ var|lower:1 }}", 1, 13, `filter "lower" accepts no arguments`},
+	{"{{ var|cut }}", 1, 12, `filter "cut" requires an argument`},
+	{"{% for x in y %}\n{{ x }}", 2, 8, "unterminated for tag"},
+	{"{% if %}{% endif %}", 1, 7, `unexpected %} "%}"`},
+	{"{{ 'abc }}", 1, 4, "unterminated string"},
+	{"{# comment", 1, 1, "unterminated comment"},
+	{"{% for x y %}{% endfor %}", 1, 10, "expected ident in, got Token ident, y"},
+	{"ü{{ + }}", 1, 7, `unexpected }} "}}"`},
+	{"{% block a %}{% endblock %}\n{% block a %}{% endblock %}", 2, 10, `block "a" defined more than once`},
+	{"{% block a %}{% endblock b %}", 1, 26, `endblock "b" doesn't match block "a"`},
+	{"<p>{{ x }}</p>\n{% extends 'base' %}", 2, 12, "extends must be the first tag in the template"},
+	{"{% block a %}{% endblock %}{% extends 'base' %}", 1, 39, "extends must be the first tag in the template"},
+}
+
+func TestParseErrors(t *testing.T) {
+	for i, test := range parseErrorTests {
+		temp, err := ParseString(test.template)
+		if temp != nil {
+			t.Errorf("#%d got a template for a parse error", i)
+		}
+		var perr *ParseError
+		if !errors.As(err, &perr) {
+			t.Errorf("#%d got error %v, want a *ParseError", i, err)
+			continue
+		}
+		if perr.Line != test.line || perr.Column != test.column || perr.Msg != test.msg {
+			t.Errorf("#%d got %d:%d: %s want %d:%d: %s", i, perr.Line, perr.Column, perr.Msg,
+				test.line, test.column, test.msg)
+		}
+	}
+}
+
+func TestParseErrorExcerpt(t *testing.T) {
+	_, err := ParseString("first line\n\t{{ 1 + }} end")
+	var perr *ParseError
+	if !errors.As(err, &perr) {
+		t.Fatalf("got error %v, want a *ParseError", err)
+	}
+	if want := "\t{{ 1 + }} end\n\t       ^"; perr.Excerpt != want {
+		t.Errorf("got excerpt %q want %q", perr.Excerpt, want)
+	}
+	if perr.Tok != TokVarEnd || perr.Lit != "}}" {
+		t.Errorf("got token %s %q want }} %q", perr.Tok, perr.Lit, "}}")
+	}
+}
+
+func TestParseFileError(t *testing.T) {
+	_, err := ParseFile("testdata/broken")
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	if want := `testdata/broken:2:4: unknown tag "oops"`; err.Error() != want {
+		t.Errorf("got %q want %q", err.Error(), want)
+	}
+}
+
+func TestParseErrorList(t *testing.T) {
+	src := `{% nosuchtag %}{{ a|nosuchfilter }}
+{% for x in xs %}{{ x|lower:1 }}{% bogus 1 2 %}{% endfor %}
+{{ 'ok' }}{{ b|cut }}{% if a %}`
+	_, err := ParseString(src)
+	list, ok := err.(ErrorList)
+	if !ok {
+		t.Fatalf("got error %v, want an ErrorList", err)
+	}
+	want := []string{
+		`1:4: unknown tag "nosuchtag"`,
+		`1:21: unknown filter "nosuchfilter"`,
+		`2:28: filter "lower" accepts no arguments`,
+		`2:36: unknown tag "bogus"`,
+		`3:20: filter "cut" requires an argument`,
+		`3:32: unterminated if tag`,
+	}
+	if len(list) != len(want) {
+		t.Fatalf("got %d errors want %d: %v", len(list), len(want), list)
+	}
+	for i, err := range list {
+		if err.Error() != want[i] {
+			t.Errorf("#%d got %q want %q", i, err.Error(), want[i])
+		}
+	}
+	if want := want[0] + " (and 5 more errors)"; err.Error() != want {
+		t.Errorf("got %q want %q", err.Error(), want)
+	}
+}
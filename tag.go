@@ -2,54 +2,177 @@ package template
 
 import (
 	"bytes"
+	"fmt"
 	"io"
 	"reflect"
 )
 
+// A TagFunc parses a tag and returns the Node that renders it. It's called
+// with the Parser positioned after the tag name and must return with the
+// Parser at the "%}" that ends the tag, or that ends its closing tag for tags
+// with a body, such as "{% endfor %}".
 type TagFunc func(p *Parser) Node
 
-var tags = map[string]TagFunc{
-	"block":     parseBlock,
-	"cycle":     parseCycle,
-	"extends":   parseExtends,
-	"firstof":   parseFirstof,
-	"for":       parseFor,
-	"if":        parseIf,
-	"ifchanged": parseIfChanged,
-	"include":   parseInclude,
-	"override":  parseOverride,
-	"set":       parseSet,
-	"with":      parseWith,
+var builtinTags = map[string]TagFunc{
+	"autoescape": parseAutoescape,
+	"block":      parseBlock,
+	"cycle":      parseCycle,
+	"extends":    parseExtends,
+	"firstof":    parseFirstof,
+	"for":        parseFor,
+	"if":         parseIf,
+	"ifchanged":  parseIfChanged,
+	"include":    parseInclude,
+	"override":   parseOverride,
+	"set":        parseSet,
+	"with":       parseWith,
 }
 
+// A blockTag is a named section of a template that templates extending it
+// can replace. Inside the block, {{ block.super }} renders the version of
+// the block it replaced.
 type blockTag struct {
-	name  Variable
+	pos   Position
+	name  string
+	super Variable // the "block" variable
+	init  Node
 	nodes NodeList
+	ctx   blockContext
+}
+
+// A blockRef is a version of a block in a chain of templates extending each
+// other, along with the Context to render it in.
+type blockRef struct {
+	b *blockTag
+	c *Context
+}
+
+// addBlocks adds blocks, which are rendered in c, to the end of the chains
+// in m.
+func addBlocks(m map[string][]blockRef, blocks []*blockTag, c *Context) {
+	for _, b := range blocks {
+		m[b.name] = append(m[b.name], blockRef{b, c})
+	}
 }
 
 func parseBlock(p *Parser) Node {
+	if p.Current() == TokIdent && p.blockNames[p.Lit()] {
+		// report the error but parse the block anyway, so that its
+		// endblock doesn't cause more errors
+		p.errors = append(p.errors, p.newError(fmt.Sprintf("block %q defined more than once", p.Lit())))
+	}
+	pos := p.Pos()
 	name := p.Expect(TokIdent)
+	p.blockNames[name] = true
 	p.Expect(TokTagEnd)
+	parent, replaces := p.parentCtx[name]
+	if replaces {
+		// start where the block being replaced is
+		p.html = parent.start
+	}
+	start := p.html
+	scope := p.Scope()
+	scope.Push()
+	super := scope.Insert("block")
 	tok, nodes := p.ParseUntil("endblock")
 	if tok != "endblock" {
 		p.Error("unterminated block tag")
 	}
-	nameVar := p.Scope().Lookup("@" + name)
-	return &blockTag{nameVar, nodes}
+	ctx := blockContext{start, p.html}
+	if replaces && !ctx.fits(parent) {
+		p.htmlError("block %q ends in a different HTML context than the block it replaces", name)
+	}
+	// the block may be replaced by a version that ends a little differently
+	p.html = p.html.widen()
+	if p.Current() == TokIdent && p.Lit() != name {
+		p.Error("endblock %q doesn't match block %q", p.Lit(), name)
+	} else if p.Current() == TokIdent {
+		p.Next()
+	}
+	b := &blockTag{pos, name, super, scope.Pop(), nodes, ctx}
+	p.blocks = append(p.blocks, b)
+	return b
 }
 
-func (b *blockTag) Render(wr io.Writer, c *Context) {
-	val := b.name.Eval(c)
-	if val.Bool() {
-		val.Render(wr, c)
-		return
+func (b *blockTag) Render(wr io.Writer, c *Context) error {
+	// the most derived template's version of the block wins
+	if chain := c.blocks[b.name]; len(chain) > 0 {
+		if c.opts.contextual {
+			// the versions were parsed apart from b when the template
+			// they extend wasn't known
+			for _, ref := range chain {
+				if !ref.b.ctx.fits(b.ctx) {
+					return b.contextError()
+				}
+			}
+		}
+		return renderBlock(wr, chain)
+	}
+	if o := c.overrides[b.name]; o.out != "" {
+		if c.opts.contextual && !o.ctx.fits(b.ctx) {
+			return b.contextError()
+		}
+		return writeString(wr, o.out)
 	}
-	b.nodes.Render(wr, c)
+	return renderBlock(wr, []blockRef{{b, c}})
+}
+
+func (b *blockTag) contextError() error {
+	return &ExecError{b.pos, fmt.Errorf("block %q is replaced by a version in a different HTML context", b.name)}
+}
+
+// renderBlock renders the first block in chain. The rest are the blocks it
+// replaced, which its block.super renders.
+func renderBlock(wr io.Writer, chain []blockRef) error {
+	ref := chain[0]
+	if err := ref.b.init.Render(wr, ref.c); err != nil {
+		return err
+	}
+	ref.b.super.Set(blockValue{super: chain[1:]}, ref.c)
+	return ref.b.nodes.Render(wr, ref.c)
+}
+
+// A blockValue is the value of the "block" variable inside a block. Its
+// only attribute is super.
+type blockValue struct {
+	nilValue
+	super superValue
+}
+
+// A superValue renders the block replaced by the block being rendered, or
+// nothing if it didn't replace one.
+type superValue []blockRef
+
+func (s superValue) Bool() bool             { return s.String() != "" }
+func (s superValue) Int() int64             { return stringValue(s.String()).Int() }
+func (s superValue) Float() float64         { return stringValue(s.String()).Float() }
+func (s superValue) Uint() uint64           { return stringValue(s.String()).Uint() }
+func (s superValue) Reflect() reflect.Value { return reflect.ValueOf(s.String()) }
+
+func (s superValue) String() string {
+	var buf bytes.Buffer
+	if err := s.Render(&buf, nil); err != nil {
+		// bytes.Buffer doesn't fail, so this came from executing the block
+		e, ok := err.(*ExecError)
+		if !ok {
+			e = &ExecError{Err: err}
+		}
+		panic(e)
+	}
+	return buf.String()
+}
+
+func (s superValue) Render(wr io.Writer, c *Context) error {
+	if len(s) == 0 {
+		return nil
+	}
+	return renderBlock(wr, s)
 }
 
 type cycleTag struct {
 	args  []Expr
 	state Variable
+	esc   escaping
 }
 
 func parseCycle(p *Parser) Node {
@@ -62,73 +185,149 @@ func parseCycle(p *Parser) Node {
 		p.Error("the cycle tag requires at least one parameter")
 	}
 	state := p.Scope().Anonymous(intValue(0))
-	return &cycleTag{args, state}
+	return &cycleTag{args, state, p.escaping()}
 }
 
-func (t cycleTag) Render(wr io.Writer, c *Context) {
+func (t cycleTag) Render(wr io.Writer, c *Context) error {
 	i := t.state.Eval(c).Int()
-	t.args[i].Eval(c).Render(wr, c)
+	if err := renderValue(wr, c, t.args[i].Eval(c), t.esc); err != nil {
+		return err
+	}
 	i++
 	if int(i) >= len(t.args) {
 		i = 0
 	}
 	t.state.Set(intValue(i), c)
+	return nil
 }
 
+// An extendsTag renders a parent template. It takes two forms:
+//
+//	{% extends parent %}{% block name %}...{% endblock %}
+//	{% extends parent %}{% override name %}...{% endoverride %}{% endextends %}
+//
+// In the first form, the extends tag must be the first tag in the template;
+// it covers the rest of the template and the blocks in it replace the
+// parent's blocks of the same name.
 type extendsTag struct {
+	pos    Position
+	env    *Environment
 	parent Expr
+	t      *Template // the parent template, if it was loaded while parsing
 	nodes  NodeList
+	blocks []*blockTag // nil unless the tag has the first form
 }
 
 func parseExtends(p *Parser) Node {
+	pos := p.Pos()
+	var notFirst *ParseError
+	if p.ntags > 1 {
+		notFirst = p.newError("extends must be the first tag in the template")
+	}
 	parent := p.ParseExpr()
+	t := p.preload(parent)
 	p.Expect(TokTagEnd)
+	ctx := p.html
+	oldParent := p.parentCtx
+	if t != nil {
+		p.parentCtx = t.contexts
+	}
+	start := len(p.blocks)
 	tok, nodes := p.ParseUntil("endextends")
+	tag := &extendsTag{pos, p.env, parent, t, nodes, nil}
 	if tok != "endextends" {
-		p.Error("unterminated extends tag")
+		// the rest of the template is the child
+		tag.blocks = p.blocks[start:]
+		if tag.blocks == nil {
+			tag.blocks = []*blockTag{}
+		}
+		p.atEnd = true
+		if notFirst != nil {
+			p.errors = append(p.errors, notFirst)
+		}
+		return tag
 	}
-	return &extendsTag{parent, nodes}
+	// the parent is rendered in place, like an included template
+	p.parentCtx = oldParent
+	p.html = ctx
+	p.checkInclude("extends", t)
+	return tag
 }
 
 type nilWriter int
 
 func (w nilWriter) Write(p []byte) (int, error) { return len(p), nil }
 
-func (e *extendsTag) Render(wr io.Writer, c *Context) {
-	parentValue := e.parent.Eval(c)
-	node, ok := parentValue.Reflect().Interface().(*Template)
-	if !ok {
-		// must be a string
-		filename := parentValue.String()
+// loadTemplate returns the template val refers to, which is either a
+// *Template or the name of a template to load from env. If the template
+// can't be loaded, the error names the tag at pos and the template it asked
+// for.
+func loadTemplate(env *Environment, tag string, pos Position, val Value) (*Template, error) {
+	if ref := val.Reflect(); ref.IsValid() && ref.CanInterface() {
+		if t, ok := ref.Interface().(*Template); ok {
+			return t, nil
+		}
+	}
+	// must be a string
+	name := val.String()
+	t, err := env.Load(name)
+	if err != nil {
+		return nil, &ExecError{pos, fmt.Errorf("%s %q: %w", tag, name, err)}
+	}
+	return t, nil
+}
+
+func (e *extendsTag) Render(wr io.Writer, c *Context) error {
+	node := e.t
+	if node == nil || e.env.reloading() {
 		var err error
-		node, err = ParseFile(filename)
+		node, err = loadTemplate(e.env, "extends", e.pos, e.parent.Eval(c))
 		if err != nil {
-			return
+			if c.opts.ignoreMissing {
+				return nil
+			}
+			return err
 		}
 	}
+	if e.blocks != nil {
+		if c.blocks == nil {
+			// this is the most derived template
+			c.blocks = map[string][]blockRef{}
+			addBlocks(c.blocks, e.blocks, c)
+		}
+		return node.extend(wr, c)
+	}
+	if err := checkIncluded(c, "extends", e.pos, node); err != nil {
+		return err
+	}
 	w := nilWriter(0)
-	e.nodes.Render(w, c)
-	node.Render(wr, c)
+	if err := e.nodes.Render(w, c); err != nil {
+		return err
+	}
+	return node.Render(wr, c)
 }
 
-type firstofTag []Expr
+type firstofTag struct {
+	args []Expr
+	esc  escaping
+}
 
 func parseFirstof(p *Parser) Node {
-	tag := make(firstofTag, 0, 2)
+	args := make([]Expr, 0, 2)
 	for p.Current() != TokTagEnd {
 		v := p.ParseExpr()
-		tag = append(tag, v)
+		args = append(args, v)
 	}
-	return tag
+	return &firstofTag{args, p.escaping()}
 }
 
-func (f firstofTag) Render(wr io.Writer, c *Context) {
-	for _, expr := range f {
+func (f *firstofTag) Render(wr io.Writer, c *Context) error {
+	for _, expr := range f.args {
 		if val := expr.Eval(c); val.Bool() {
-			val.Render(wr, c)
-			return
+			return renderValue(wr, c, val, f.esc)
 		}
 	}
+	return nil
 }
 
 type forTag struct {
@@ -145,13 +344,21 @@ func parseFor(p *Parser) Node {
 	name := p.Expect(TokIdent)
 	v := scope.Insert(name)
 	p.ExpectWord("in")
+	pos := p.Pos()
 	collection := p.ParseExpr()
+	p.setType(v, p.rangeType(p.typeOf(collection), pos))
 	p.Expect(TokTagEnd)
+	start := p.html
 	tok, body := p.ParseUntil("else", "endfor")
+	// the body may be rendered again or not at all
+	p.joinHTML("for", start)
 	var elseNode Node
 	if tok == "else" {
+		end := p.html
+		p.html = start
 		p.Expect(TokTagEnd)
 		tok, elseNode = p.ParseUntil("endfor")
+		p.joinHTML("for", end)
 	}
 	if tok != "endfor" {
 		p.Error("unterminated for tag")
@@ -160,8 +367,10 @@ func parseFor(p *Parser) Node {
 }
 
 // TODO: this needs reworking. We need a good way to set Variables on the stack.
-func (f *forTag) Render(wr io.Writer, c *Context) {
-	f.init.Render(wr, c)
+func (f *forTag) Render(wr io.Writer, c *Context) error {
+	if err := f.init.Render(wr, c); err != nil {
+		return err
+	}
 	colVal := f.collection.Eval(c)
 	v := colVal.Reflect()
 	v = reflect.Indirect(v)
@@ -172,13 +381,17 @@ func (f *forTag) Render(wr io.Writer, c *Context) {
 		n = len(v)
 		for _, ch := range v {
 			f.v.Set(stringValue(ch), c)
-			f.body.Render(wr, c)
+			if err := f.body.Render(wr, c); err != nil {
+				return err
+			}
 		}
 	case reflect.Array, reflect.Slice:
 		n = v.Len()
 		for i := 0; i < n; i++ {
 			f.v.Set(refToVal(v.Index(i)), c)
-			f.body.Render(wr, c)
+			if err := f.body.Render(wr, c); err != nil {
+				return err
+			}
 		}
 	case reflect.Chan:
 		for {
@@ -187,25 +400,32 @@ func (f *forTag) Render(wr io.Writer, c *Context) {
 				break
 			}
 			f.v.Set(refToVal(x), c)
-			f.body.Render(wr, c)
+			if err := f.body.Render(wr, c); err != nil {
+				return err
+			}
 			n++
 		}
 	case reflect.Map:
 		n = v.Len()
 		for _, k := range v.MapKeys() {
 			f.v.Set(refToVal(v.MapIndex(k)), c)
-			f.body.Render(wr, c)
+			if err := f.body.Render(wr, c); err != nil {
+				return err
+			}
 		}
 	case reflect.Struct:
 		n = v.NumField()
 		for i := 0; i < n; i++ {
 			f.v.Set(refToVal(v.Field(i)), c)
-			f.body.Render(wr, c)
+			if err := f.body.Render(wr, c); err != nil {
+				return err
+			}
 		}
 	}
 	if n == 0 && f.elseNode != nil {
-		f.elseNode.Render(wr, c)
+		return f.elseNode.Render(wr, c)
 	}
+	return nil
 }
 
 type ifTag struct {
@@ -218,12 +438,16 @@ func parseIf(p *Parser) Node {
 	tag := new(ifTag)
 	tag.cond = p.ParseExpr()
 	p.Expect(TokTagEnd)
+	start := p.html
 	var tok string
 	tok, tag.ifNode = p.ParseUntil("elif", "else", "endif")
+	end := p.html
+	p.html = start
 	for tok != "endif" {
 		switch tok {
 		case "elif":
 			tag.elseNode = parseIf(p)
+			p.joinHTML("if", end)
 			return tag
 		case "else":
 			tok, tag.elseNode = p.ParseUntil("endif")
@@ -231,15 +455,17 @@ func parseIf(p *Parser) Node {
 			p.Error("unterminated if tag")
 		}
 	}
+	p.joinHTML("if", end)
 	return tag
 }
 
-func (i *ifTag) Render(wr io.Writer, c *Context) {
+func (i *ifTag) Render(wr io.Writer, c *Context) error {
 	if i.cond.Eval(c).Bool() {
-		i.ifNode.Render(wr, c)
+		return i.ifNode.Render(wr, c)
 	} else if i.elseNode != nil {
-		i.elseNode.Render(wr, c)
+		return i.elseNode.Render(wr, c)
 	}
+	return nil
 }
 
 type ifChangedTag struct {
@@ -262,57 +488,90 @@ func parseIfChanged(p *Parser) Node {
 		// change the first time
 		vars[i] = p.Scope().Anonymous(nilValue(1))
 	}
+	start := p.html
 	tok, ifNodes := p.ParseUntil("else", "endifchanged")
+	end := p.html
+	p.html = start
 	var elseNodes NodeList
 	if tok == "else" {
 		p.Expect(TokTagEnd)
 		tok, elseNodes = p.ParseUntil("endifchanged")
 	}
+	p.joinHTML("ifchanged", end)
 	if tok != "endifchanged" {
 		p.Error("unterminated ifchanged tag")
 	}
 	return &ifChangedTag{args, vars, ifNodes, elseNodes}
 }
 
-func (t *ifChangedTag) Render(wr io.Writer, c *Context) {
+func (t *ifChangedTag) Render(wr io.Writer, c *Context) error {
 	changed := false
 	for i, v := range t.last {
 		new := t.vals[i].Eval(c)
-		// TODO: new != old can panic depending on the concrete values
-		if !changed && new != v.Eval(c) {
+		if old := v.Eval(c); !changed && (old == nilValue(1) || !equal(new, old)) {
 			changed = true
 		}
 		v.Set(new, c)
 	}
 	if changed {
-		t.ifNodes.Render(wr, c)
+		return t.ifNodes.Render(wr, c)
 	} else if t.elseNodes != nil {
-		t.elseNodes.Render(wr, c)
+		return t.elseNodes.Render(wr, c)
 	}
+	return nil
 }
 
 type includeTag struct {
-	e Expr
+	pos Position
+	env *Environment
+	e   Expr
+	t   *Template // the included template, if it was loaded while parsing
 }
 
 func parseInclude(p *Parser) Node {
+	pos := p.Pos()
 	expr := p.ParseExpr()
-	return includeTag{expr}
+	t := p.preload(expr)
+	p.checkInclude("include", t)
+	return includeTag{pos, p.env, expr, t}
+}
+
+// checkInclude checks the HTML context of a tag that renders the template
+// t, which is nil if it wasn't loaded while parsing. The template is parsed
+// starting in text, so that's where the tag must be and t must end.
+func (p *Parser) checkInclude(tag string, t *Template) {
+	if p.html != (htmlContext{}) {
+		p.htmlError("%s tag outside of HTML text", tag)
+	} else if t != nil && t.end != (htmlContext{}) {
+		p.htmlError("%s tag's template %q doesn't end in HTML text", tag, t.name)
+	}
+}
+
+// checkIncluded is the check of checkInclude for a template t loaded while
+// rendering.
+func checkIncluded(c *Context, tag string, pos Position, t *Template) error {
+	if c.opts.contextual && t.end != (htmlContext{}) {
+		return &ExecError{pos, fmt.Errorf("%s %q: template doesn't end in HTML text", tag, t.name)}
+	}
+	return nil
 }
 
-func (i includeTag) Render(wr io.Writer, c *Context) {
-	val := i.e.Eval(c)
-	node, ok := val.Reflect().Interface().(*Template)
-	if !ok {
-		// must be a string
-		filename := val.String()
+func (i includeTag) Render(wr io.Writer, c *Context) error {
+	node := i.t
+	if node == nil || i.env.reloading() {
 		var err error
-		node, err = ParseFile(filename)
+		node, err = loadTemplate(i.env, "include", i.pos, i.e.Eval(c))
 		if err != nil {
-			return
+			if c.opts.ignoreMissing {
+				return nil
+			}
+			return err
 		}
 	}
-	node.Render(wr, c)
+	if err := checkIncluded(c, "include", i.pos, node); err != nil {
+		return err
+	}
+	return node.Render(wr, c)
 }
 
 type setTag struct {
@@ -321,40 +580,61 @@ type setTag struct {
 }
 
 type overrideTag struct {
-	name    string
-	nameVar Variable
-	nodes   NodeList
+	name  string
+	nodes NodeList
+	ctx   blockContext
+}
+
+// An override is the output of an override tag, along with the HTML
+// context it was rendered for.
+type override struct {
+	out string
+	ctx blockContext
 }
 
 func parseOverride(p *Parser) Node {
 	name := p.Expect(TokIdent)
 	p.Expect(TokTagEnd)
+	// start where the block being replaced is, as for blocks
+	parent, replaces := p.parentCtx[name]
+	if replaces {
+		p.html = parent.start
+	}
+	start := p.html
 	tok, nodes := p.ParseUntil("endoverride")
 	if tok != "endoverride" {
 		p.Error("unterminated block tag")
 	}
-	name = "@" + name
-	nameVar := p.Scope().Lookup(name)
-	return &overrideTag{name, nameVar, nodes}
+	ctx := blockContext{start, p.html}
+	if replaces && !ctx.fits(parent) {
+		p.htmlError("override %q ends in a different HTML context than the block it replaces", name)
+	}
+	return &overrideTag{name, nodes, ctx}
 }
 
-func (o *overrideTag) Render(wr io.Writer, c *Context) {
+func (o *overrideTag) Render(wr io.Writer, c *Context) error {
 	var buf bytes.Buffer
-	o.nodes.Render(&buf, c)
-	str := buf.String()
-	o.nameVar.Set(stringValue(str), c)
-	c.vars[o.name] = str
+	if err := o.nodes.Render(&buf, c); err != nil {
+		return err
+	}
+	if c.overrides == nil {
+		c.overrides = map[string]override{}
+	}
+	c.overrides[o.name] = override{buf.String(), o.ctx}
+	return nil
 }
 
 func parseSet(p *Parser) Node {
 	name := p.Expect(TokIdent)
 	v := p.Scope().Insert(name)
 	e := p.ParseExpr()
+	p.setType(v, p.typeOf(e))
 	return &setTag{v, e}
 }
 
-func (t *setTag) Render(wr io.Writer, c *Context) {
+func (t *setTag) Render(wr io.Writer, c *Context) error {
 	t.v.Set(t.e.Eval(c), c)
+	return nil
 }
 
 type with NodeList
@@ -374,4 +654,4 @@ func parseWith(p *Parser) Node {
 	return with(nodes)
 }
 
-func (w with) Render(wr io.Writer, c *Context) { NodeList(w).Render(wr, c) }
+func (w with) Render(wr io.Writer, c *Context) error { return NodeList(w).Render(wr, c) }
@@ -1,6 +1,10 @@
 package template
 
 import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
 	"testing"
 )
 
@@ -60,3 +64,107 @@ var tagTests = []templateTest{
 func TestTags(t *testing.T) {
 	testTemplates(t, tagTests)
 }
+
+func TestIncludeErrors(t *testing.T) {
+	tests := []struct {
+		template string
+		msg      string
+		ignored  string // output with include=ignore
+	}{
+		{"a\n  {% include 'testdata/nosuchfile' %}", `2:14: include "testdata/nosuchfile": open testdata/nosuchfile: no such file or directory`, "a\n  "},
+		{"{% include var %}!", `1:12: include "": open : no such file or directory`, "!"},
+		{"{% extends 'testdata/nosuchfile' %}{% endextends %}", `1:12: extends "testdata/nosuchfile": open testdata/nosuchfile: no such file or directory`, ""},
+	}
+	for i, test := range tests {
+		temp := MustParseString(test.template)
+		var buf bytes.Buffer
+		err := temp.Execute(&buf, nil)
+		if err == nil || err.Error() != test.msg {
+			t.Errorf("#%d got error %v want %s", i, err, test.msg)
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("#%d error %v doesn't wrap fs.ErrNotExist", i, err)
+		}
+
+		buf.Reset()
+		err = temp.Option("include=ignore").Execute(&buf, nil)
+		if err != nil || buf.String() != test.ignored {
+			t.Errorf("#%d lenient: got %q, %v", i, buf.String(), err)
+		}
+	}
+}
+
+func TestIncludeParseError(t *testing.T) {
+	temp, err := ParseFile("testdata/includer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	err = temp.Execute(&buf, nil)
+	want := `testdata/includer:2:12: include "testdata/broken": testdata/broken:2:4: unknown tag "oops"`
+	if err == nil || err.Error() != want {
+		t.Errorf("got error %v want %s", err, want)
+	}
+	var list ErrorList
+	if !errors.As(err, &list) || len(list) != 1 {
+		t.Errorf("error %v doesn't wrap the parse error", err)
+	}
+	if buf.String() != "before\n" {
+		t.Errorf("got output %q", buf.String())
+	}
+}
+
+type repeatTag struct {
+	count Expr
+	i     Variable
+	body  NodeList
+}
+
+// parseRepeat parses {% repeat n times %}...{% endrepeat %}, making the
+// iteration number available as "i" inside the body.
+func parseRepeat(p *Parser) Node {
+	count := p.ParseExpr()
+	p.ExpectWord("times")
+	p.Expect(TokTagEnd)
+	p.Scope().Push()
+	i := p.Scope().Insert("i")
+	tok, body := p.ParseUntil("endrepeat")
+	if tok != "endrepeat" {
+		p.Error("unterminated repeat tag")
+	}
+	p.Scope().Pop()
+	return &repeatTag{count, i, body}
+}
+
+func (r *repeatTag) Render(wr io.Writer, c *Context) error {
+	n := r.count.Eval(c).Int()
+	for i := int64(0); i < n; i++ {
+		r.i.Set(ValueOf(i), c)
+		if err := r.body.Render(wr, c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestRegisterTag(t *testing.T) {
+	env := NewEnvironment()
+	env.RegisterTag("repeat", parseRepeat)
+	testEnv(t, env, []templateTest{
+		{"{% repeat 3 times %}{{ i }}{% endrepeat %}", nil, "012"},
+		{"{% repeat n times %}{% repeat 2 times %}{{ i }}{% endrepeat %}{{ i }} {% endrepeat %}", c{"n": 2}, "010 011 "},
+	})
+
+	_, err := env.ParseString("{% repeat 3 %}{% endrepeat %}")
+	var perr *ParseError
+	if want := "1:13: expected ident times, got Token %}, %}"; !errors.As(err, &perr) || perr.Error() != want {
+		t.Errorf("got error %v want %s", err, want)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("registering a tag twice didn't panic")
+		}
+	}()
+	env.RegisterTag("for", parseRepeat)
+}
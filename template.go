@@ -1,25 +1,103 @@
 package template
 
 import (
+	"fmt"
 	"io"
 	"reflect"
+	"sort"
+	"strings"
+	"time"
 )
 
 type Context struct {
-	vars  map[string]interface{}
+	data  reflect.Value // the data passed to Execute
 	stack []Value
+	opts  options
+	// blocks holds the versions of each block when the template is part of
+	// a chain of templates extending each other, most derived first. It's
+	// shared by the Contexts of all the templates in the chain.
+	blocks map[string][]blockRef
+	// overrides holds the output of override tags by block name. It's
+	// passed on to the templates rendered from this one.
+	overrides map[string]override
+	// autoescape says whether the template escapes the values it prints by
+	// default.
+	autoescape bool
 }
 
-func newContext(s *scope, vars map[string]interface{}) *Context {
+func newContext(s *Scope, data reflect.Value, opts options) *Context {
 	stack := make([]Value, s.maxLen)
-	if vars != nil {
+	if data.IsValid() {
 		for k, v := range s.top() {
-			if val, ok := vars[k]; ok {
-				stack[v] = refToVal(reflect.ValueOf(val))
+			if ref := lookup(data, k); ref.IsValid() {
+				stack[v] = refToVal(ref)
 			}
 		}
 	}
-	return &Context{vars, stack}
+	return &Context{data: data, stack: stack, opts: opts}
+}
+
+// options control how a template executes.
+type options struct {
+	// ignoreMissing makes include and extends tags render nothing when
+	// their template can't be loaded.
+	ignoreMissing bool
+	// autoescape is escDefault if autoescaping depends on the template's
+	// name.
+	autoescape escMode
+	// contextual makes escaping depend on where in the HTML the value is.
+	contextual bool
+	// strict makes undefined variables and attributes errors.
+	strict bool
+}
+
+// set sets an option given as "key=value", panicking if it's unknown.
+func (o *options) set(opt string) {
+	key, value, ok := strings.Cut(opt, "=")
+	if ok {
+		switch key {
+		case "include":
+			switch value {
+			case "error":
+				o.ignoreMissing = false
+				return
+			case "ignore":
+				o.ignoreMissing = true
+				return
+			}
+		case "autoescape":
+			switch value {
+			case "auto":
+				o.autoescape = escDefault
+				return
+			case "on":
+				o.autoescape = escOn
+				return
+			case "off":
+				o.autoescape = escOff
+				return
+			}
+		case "undefined":
+			switch value {
+			case "ignore":
+				o.strict = false
+				return
+			case "error":
+				o.strict = true
+				return
+			}
+		case "escape":
+			switch value {
+			case "html":
+				o.contextual = false
+				return
+			case "contextual":
+				o.contextual = true
+				return
+			}
+		}
+	}
+	panic(fmt.Sprintf("template: unknown option %q", opt))
 }
 
 type scopeLevel struct {
@@ -27,33 +105,40 @@ type scopeLevel struct {
 	// This node initializes anonymous variables.
 	// It's up to the popper of this level to make sure these run.
 	init initNode
+	// types holds the static types of Variables, for ParseTyped.
+	types map[Variable]reflect.Type
 }
 
-type scope struct {
+// A Scope allocates the Variables of a template during parsing. Names are
+// resolved from the innermost level outward, like block scoping in Go.
+type Scope struct {
 	levels []*scopeLevel
 	// the greatest number of Variables this scope and its children can hold
 	maxLen int
+	// free holds the names Lookup didn't find, which are read from the data
+	// passed to Execute.
+	free map[string]bool
 }
 
-func newScope() *scope {
-	s := new(scope)
-	level := &scopeLevel{map[string]Variable{}, map[Variable]Value{}}
+func newScope() *Scope {
+	s := &Scope{free: map[string]bool{}}
+	level := &scopeLevel{named: map[string]Variable{}, init: map[Variable]Value{}}
 	s.levels = []*scopeLevel{level}
 	return s
 }
 
-func (s *scope) top() map[string]Variable {
+func (s *Scope) top() map[string]Variable {
 	return s.levels[len(s.levels)-1].named
 }
 
 // Push creates a new scope level
-func (s *scope) Push() {
-	level := &scopeLevel{map[string]Variable{}, map[Variable]Value{}}
+func (s *Scope) Push() {
+	level := &scopeLevel{named: map[string]Variable{}, init: map[Variable]Value{}}
 	s.levels = append(s.levels, level)
 }
 
 // Pop removes the top scope
-func (s *scope) Pop() Node {
+func (s *Scope) Pop() Node {
 	if len(s.levels) == 1 {
 		return initNode(nil)
 	}
@@ -67,7 +152,7 @@ func (s *scope) Pop() Node {
 
 // len returns the number of variables that need to be allocated for the
 // current stack of scopes.
-func (s *scope) len() int {
+func (s *Scope) len() int {
 	l := 0
 	for _, level := range s.levels {
 		l += len(level.named) + len(level.init)
@@ -79,7 +164,7 @@ func (s *scope) len() int {
 // possible scope.
 // If the name cannot be found, it is inserted into the broadest scope and
 // the new Variable is returned.
-func (s *scope) Lookup(name string) Variable {
+func (s *Scope) Lookup(name string) Variable {
 	l := len(s.levels)
 	for i := l - 1; i >= 0; i-- {
 		if v, ok := s.levels[i].named[name]; ok {
@@ -89,13 +174,21 @@ func (s *scope) Lookup(name string) Variable {
 	v := Variable(s.maxLen)
 	s.levels[0].named[name] = v
 	s.maxLen++
+	s.free[name] = true
 	return v
 }
 
+// isFree reports whether v, which was returned by Lookup(name), is read from
+// the data passed to Execute.
+func (s *Scope) isFree(name string, v Variable) bool {
+	w, ok := s.levels[0].named[name]
+	return ok && w == v && s.free[name]
+}
+
 // Insert creates a new Variable at the top scope and returns it.
 // If the Variable already exists in that scope, the existing Variable is
 // returned.
-func (s *scope) Insert(name string) Variable {
+func (s *Scope) Insert(name string) Variable {
 	l := len(s.levels)
 	v, ok := s.levels[l-1].named[name]
 	if ok {
@@ -110,7 +203,7 @@ func (s *scope) Insert(name string) Variable {
 // Anonymous creates a new anonymous Variable at the top scope and returns it.
 // This is useful for Nodes that might Render more than once and want to
 // store state between Renders.
-func (s *scope) Anonymous(init Value) Variable {
+func (s *Scope) Anonymous(init Value) Variable {
 	v := Variable(s.len())
 	level := s.levels[len(s.levels)-1]
 	level.init[v] = init
@@ -120,57 +213,249 @@ func (s *scope) Anonymous(init Value) Variable {
 
 type initNode map[Variable]Value
 
-func (i initNode) Render(wr io.Writer, c *Context) {
+func (i initNode) Render(wr io.Writer, c *Context) error {
 	for v, val := range i {
 		v.Set(val, c)
 	}
+	return nil
 }
 
 // A Node represents a part of the Template, such as a tag or a block of text.
 type Node interface {
 	// Render evaluates the node with the given Context and writes the result to
-	// wr.
+	// wr. It stops and returns the first error encountered, including any
+	// error from writing to wr.
 	// Render should be reentrant. If the Node needs to store state, it should
 	// allocate a Variable on the stack during parsing and use that Variable.
-	Render(wr io.Writer, c *Context)
+	Render(wr io.Writer, c *Context) error
 }
 
 type NodeList []Node
 
-func (l NodeList) Render(wr io.Writer, c *Context) {
+func (l NodeList) Render(wr io.Writer, c *Context) error {
 	for _, r := range l {
-		r.Render(wr, c)
+		if err := r.Render(wr, c); err != nil {
+			return err
+		}
 	}
+	return nil
 }
 
 type printLit []byte
 
-func (p printLit) Render(wr io.Writer, c *Context) { wr.Write([]byte(p)) }
+func (p printLit) Render(wr io.Writer, c *Context) error {
+	_, err := wr.Write([]byte(p))
+	return err
+}
 
 type varTag struct {
-	e Expr
+	e   Expr
+	esc escaping
 }
 
-func (v varTag) Render(wr io.Writer, c *Context) { v.e.Eval(c).Render(wr, c) }
+func (v varTag) Render(wr io.Writer, c *Context) error {
+	return renderValue(wr, c, v.e.Eval(c), v.esc)
+}
 
 type Template struct {
-	scope *scope
+	name  string
+	env   *Environment
+	scope *Scope
 	nodes NodeList
+	opts  options
+	// blocks holds the template's block tags
+	blocks []*blockTag
+	// paths holds the attribute paths read from free variables.
+	paths []string
+	// contexts holds the HTML contexts of the blocks of the template and
+	// of the templates it extends, by name. end is the context at the end
+	// of the template.
+	contexts map[string]blockContext
+	end      htmlContext
+	// htmlErr is the first error found in tracking the HTML context,
+	// returned when the template is executed with escape=contextual.
+	htmlErr error
+
+	// modTime is the modification time of the template's source when it
+	// was loaded, if known.
+	modTime time.Time
+}
+
+// Name returns the name of the template, which is the file name for
+// templates created with ParseFile and empty otherwise.
+func (t *Template) Name() string {
+	return t.name
+}
+
+// Variables returns the names of the variables the template reads from the
+// data passed to Execute, in sorted order. Variables the template sets
+// itself, such as loop variables, aren't included. Neither are the
+// variables read by templates the template includes or extends; call
+// Variables on those templates to get them.
+func (t *Template) Variables() []string {
+	return t.variables(false)
 }
 
-func (t *Template) Execute(wr io.Writer, vars map[string]interface{}) {
-	c := newContext(t.scope, vars)
-	t.render(wr, c)
+// VariablePaths is like Variables, but also returns the attribute paths read
+// from the variables, such as "user.name".
+func (t *Template) VariablePaths() []string {
+	return t.variables(true)
 }
 
-func (t *Template) Render(wr io.Writer, c *Context) {
+func (t *Template) variables(paths bool) []string {
+	names := make(map[string]bool)
+	for name := range t.scope.free {
+		names[name] = true
+	}
+	if paths {
+		for _, p := range t.paths {
+			names[p] = true
+		}
+	}
+	list := make([]string, 0, len(names))
+	for name := range names {
+		list = append(list, name)
+	}
+	sort.Strings(list)
+	return list
+}
+
+// Option sets options for the template. Options are strings of the form
+// "key=value". Option panics if an option is unknown or malformed.
+//
+// Known options:
+//
+//	include=error
+//		The default. If an include or extends tag can't load its
+//		template, execution stops with an *ExecError.
+//	include=ignore
+//		An include or extends tag whose template can't be loaded
+//		renders nothing.
+//	autoescape=auto
+//		The default. Templates whose names end in .html, .htm, .xhtml
+//		or .xml HTML-escape the values they print, except for
+//		SafeStrings; other templates print values as they are.
+//	autoescape=on
+//		All templates escape the values they print.
+//	autoescape=off
+//		No template escapes the values it prints.
+//
+//	undefined=ignore
+//		The default. Variables that aren't set and attributes that
+//		don't exist are empty.
+//	undefined=error
+//		Using a variable that isn't set or an attribute that doesn't
+//		exist stops execution with an *ExecError naming it. So does
+//		comparing nil with <, <=, > or >=, which is otherwise false.
+//	escape=html
+//		The default. Escaped values are HTML-escaped.
+//	escape=contextual
+//		Escaped values are escaped according to where they appear
+//		in the HTML: in script and style elements, in event handler,
+//		style and URL attributes, or elsewhere. URLs with schemes
+//		other than http, https and mailto are replaced. The branches
+//		of if, ifchanged and for tags must end in the same context,
+//		a block must start and end in the same context as the block
+//		it replaces, and include and extends tags with endextends
+//		must be in text, outside of any tag, and their templates
+//		must end there. Otherwise parsing fails if the Environment
+//		has this option, and executing fails if only the template
+//		does.
+//
+// The autoescape tag overrides the autoescape option for its body.
+//
+// The options of the executed template also apply to the templates it
+// includes or extends.
+func (t *Template) Option(opt ...string) *Template {
+	for _, o := range opt {
+		t.opts.set(o)
+	}
+	return t
+}
+
+// Environment returns the Environment the template was parsed with.
+func (t *Template) Environment() *Environment {
+	return t.env
+}
+
+// Execute renders the template to wr. The template's variables are read
+// from data, which is a struct, a pointer to a struct, a map with string
+// keys, or nil. Variables are looked up in data the same way attributes are
+// looked up in values, so {{ name }} is the field or map element of data
+// called name. Failing that, it's the result of the method of data called
+// name, which must take no arguments and return a value, optionally
+// followed by an error that stops rendering. Rendering stops at the first
+// error, which is returned. If the error came from wr, the output is
+// incomplete.
+//
+// Execute doesn't modify data, and all the state of a rendering is kept
+// apart from the Template, so a Template may be executed by multiple
+// goroutines at once, even with the same data. Option must not be called
+// during an Execute.
+func (t *Template) Execute(wr io.Writer, data interface{}) error {
+	return t.execute(wr, data, t.opts)
+}
+
+// ExecuteOptions is like Execute, but the options opt are set for this
+// execution only, in addition to the template's own. See Option for the
+// options available. ExecuteOptions panics if an option is unknown or
+// malformed.
+func (t *Template) ExecuteOptions(wr io.Writer, data interface{}, opt ...string) error {
+	opts := t.opts
+	for _, o := range opt {
+		opts.set(o)
+	}
+	return t.execute(wr, data, opts)
+}
+
+func (t *Template) execute(wr io.Writer, data interface{}, opts options) (err error) {
+	ref := reflect.ValueOf(data)
+	switch v := reflect.Indirect(ref); v.Kind() {
+	case reflect.Invalid, reflect.Struct:
+	case reflect.Map:
+		if v.Type().Key().Kind() != reflect.String {
+			return fmt.Errorf("template: can't execute with data of type %T", data)
+		}
+	default:
+		return fmt.Errorf("template: can't execute with data of type %T", data)
+	}
+	defer recoverExec(&err)
+	c := t.context(ref, opts)
+	return t.render(wr, c)
+}
+
+func (t *Template) Render(wr io.Writer, c *Context) error {
 	// we have to create a new Context that matches this template's
 	// stack layout.
-	c = newContext(t.scope, c.vars)
-	t.render(wr, c)
+	nc := t.context(c.data, c.opts)
+	nc.overrides = c.overrides
+	return t.render(wr, nc)
 }
 
-func (t *Template) render(wr io.Writer, c *Context) {
-	t.scope.levels[0].init.Render(wr, c)
-	t.nodes.Render(wr, c)
+// extend renders t as the parent of the template whose Context is c. The
+// blocks of t are added to the chain after those of the templates extending
+// it.
+func (t *Template) extend(wr io.Writer, c *Context) error {
+	nc := t.context(c.data, c.opts)
+	nc.blocks = c.blocks
+	nc.overrides = c.overrides
+	addBlocks(nc.blocks, t.blocks, nc)
+	return t.render(wr, nc)
+}
+
+// context returns a new Context for rendering t.
+func (t *Template) context(data reflect.Value, opts options) *Context {
+	c := newContext(t.scope, data, opts)
+	c.autoescape = opts.autoescapes(t.name)
+	return c
+}
+
+func (t *Template) render(wr io.Writer, c *Context) error {
+	if c.opts.contextual && t.htmlErr != nil {
+		return t.htmlErr
+	}
+	if err := t.scope.levels[0].init.Render(wr, c); err != nil {
+		return err
+	}
+	return t.nodes.Render(wr, c)
 }
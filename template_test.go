@@ -2,6 +2,9 @@ package template
 
 import (
 	"bytes"
+	"errors"
+	"reflect"
+	"sync"
 	"testing"
 )
 
@@ -24,6 +27,7 @@ var templateTests = []templateTest{
 	{"hello{", nil, "hello{"},
 	{"hello{i", nil, "hello{i"},
 	{"{# it's a comment #}", nil, ""},
+	{"{# it's a comment #} hi", nil, " hi"},
 	{"{{ 1 }}", nil, "1"},
 	{"{{ 3.14 }}", nil, "3.14"},
 	{"{{ 'hello' }}", nil, "hello"},
@@ -43,6 +47,20 @@ var templateTests = []templateTest{
 	{"{{ var.a }}", c{"var": testStruct{4, 3.14}}, "4"},
 	{"{{ var.b }}", c{"var": &testStruct{4, 3.14}}, "3.14"},
 
+	// subscripts
+	{"{{ row[col] }}", c{"row": c{"a": 1, "b": 2}, "col": "b"}, "2"},
+	{"{{ l[i] }}{{ l[-1] }}{{ l[-3] }}{{ l[2] }}{{ l[i + 1] }}", c{"l": []int{4, 5}, "i": 0}, "455"},
+	{"{{ s[1] }}{{ s[-1] }}{{ 'abc'[0] }}", c{"s": "héllo"}, "éoa"},
+	{"{{ m[1] }}{{ m[1.5] }}{{ m['2'] }}{{ n[x] }}", c{"m": map[int8]string{1: "a", 2: "b"}, "n": map[key]int{"k": 3}, "x": "k"}, "ab3"},
+	{"{{ m[1] }}{{ m[1.0] }}{{ m['a'] }}{{ m[2] }}", c{"m": map[interface{}]int{1: 5, "a": 6}}, "556"},
+	{"{{ m[1] }}{{ m['1'] }}{{ m[x] }}", c{"m": map[float64]string{1: "a"}, "x": uint8(1)}, "aa"},
+	{"{{ v[f] }}{{ v['b'] }}{{ v[0] }}", c{"v": &testStruct{4, 3.14}, "f": "a"}, "43.14"},
+	{"{{ u['Name'] }} {{ u['Greeting'] }} {{ u.Friends[-1][0] }}", c{"u": user{"ann", []string{"bob", "cy"}}}, "ann hi ann c"},
+	{"{{ l[1:3] }} {{ l[:2] }} {{ l[2:] }} {{ l[-2:] }} {{ l[:] }}", c{"l": []int{1, 2, 3, 4}}, "[2, 3] [1, 2] [3, 4] [3, 4] [1, 2, 3, 4]"},
+	{"{{ l[3:1] }} {{ l[-9:9] }} {{ a[1:] }}", c{"l": []int{1, 2}, "a": [3]int{1, 2, 3}}, "[] [1, 2] [2, 3]"},
+	{"{{ name[:3] }}|{{ name[-2:] }}|{{ name[1:2] }}|{{ name[5:] }}", c{"name": "日本語です"}, "日本語|です|本|"},
+	{"{% for x in l[1:] %}{{ x }}{% endfor %}{{ missing[1:] }}{{ missing[0] }}", c{"l": []string{"a", "b", "c"}}, "bc"},
+
 	// unary expressions
 	{"{{ +1 }}", nil, "1"},
 	{"{{ -1 }}", nil, "-1"},
@@ -54,7 +72,6 @@ var templateTests = []templateTest{
 	{"{{ 2 - 1 }}", nil, "1"},
 	{"{{ 4*4 }}", nil, "16"},
 	{"{{ 12/3 }}", nil, "4"},
-	{"{{ 12/0 }}", nil, "NaN"},
 	{"{{ 10%9 }}", nil, "1"},
 	{"{{ 10%10 }}", nil, "0"},
 
@@ -78,13 +95,21 @@ var templateTests = []templateTest{
 }
 
 func testTemplates(t *testing.T, templates []templateTest) {
+	testEnv(t, defaultEnv, templates)
+}
+
+// testEnv is like testTemplates but parses the templates with env.
+func testEnv(t *testing.T, env *Environment, templates []templateTest) {
 	for i, test := range templates {
-		temp, err := ParseString(test.template)
+		temp, err := env.ParseString(test.template)
 		if err != nil {
 			t.Errorf("#%d failed to parse: %s", i, err)
+			continue
 		}
 		buf := bytes.NewBuffer(nil)
-		temp.Execute(buf, test.vars)
+		if err := temp.Execute(buf, test.vars); err != nil {
+			t.Errorf("#%d failed to execute: %s", i, err)
+		}
 		if buf.String() != test.out {
 			t.Errorf("#%d got %q want %q", i, buf.String(), test.out)
 		}
@@ -95,6 +120,294 @@ func TestTemplate(t *testing.T) {
 	testTemplates(t, templateTests)
 }
 
+var errWrite = errors.New("write failed")
+
+// limitWriter accepts n writes and fails after that.
+type limitWriter struct {
+	n   int
+	buf bytes.Buffer
+}
+
+func (w *limitWriter) Write(p []byte) (int, error) {
+	if w.n == 0 {
+		return 0, errWrite
+	}
+	w.n--
+	return w.buf.Write(p)
+}
+
+func TestExecuteWriteError(t *testing.T) {
+	temp := MustParseString("a{{ 1 }}{% for v in var %}{{ v }}{% endfor %}{% if 1 %}b{% endif %}")
+	for n := 0; n < 6; n++ {
+		w := &limitWriter{n: n}
+		err := temp.Execute(w, c{"var": []int{2, 3}})
+		if err != errWrite {
+			t.Errorf("%d writes: got error %v want %v", n, err, errWrite)
+		}
+		if want := "a123b"[:n]; w.buf.String() != want {
+			t.Errorf("%d writes: got %q want %q", n, w.buf.String(), want)
+		}
+	}
+	w := &limitWriter{n: 6}
+	if err := temp.Execute(w, c{"var": []int{2, 3}}); err != nil {
+		t.Errorf("got error %v", err)
+	}
+}
+
+func TestExecuteConcurrent(t *testing.T) {
+	env := NewEnvironment()
+	env.SetLoader(NewMapLoader(env, map[string]string{
+		"base": "[{% block title %}base{% endblock %}]",
+		"row":  "{% cycle 'a' 'b' %}{{ x }}",
+	}))
+	tests := []templateTest{
+		{"{% extends 'base' %}{% override title %}{{ name }}{% endoverride %}{% endextends %}", nil, "[world]"},
+		{"{% extends 'base' %}{% block title %}{{ block.super }} {{ name }}{% endblock %}", nil, "[base world]"},
+		{"{% for x in list %}{% cycle 1 2 %}{% ifchanged x %}{{ x }}{% endifchanged %}{% endfor %}", nil, "1a2b1"},
+		{"{% for x in list %}{% include 'row' %}{% endfor %}", nil, "aaa"},
+		{"{% set n name %}{{ n }}", nil, "world"},
+	}
+	vars := c{"name": "world", "list": []string{"a", "b", "b"}}
+	want := c{"name": "world", "list": []string{"a", "b", "b"}}
+	temps := make([]*Template, len(tests))
+	for i, test := range tests {
+		temp, err := env.ParseString(test.template)
+		if err != nil {
+			t.Fatalf("#%d failed to parse: %s", i, err)
+		}
+		temps[i] = temp
+	}
+
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := 0; n < 20; n++ {
+				for i, temp := range temps {
+					var buf bytes.Buffer
+					if err := temp.Execute(&buf, vars); err != nil {
+						t.Errorf("#%d: %s", i, err)
+					} else if buf.String() != tests[i].out {
+						t.Errorf("#%d got %q want %q", i, buf.String(), tests[i].out)
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if !reflect.DeepEqual(vars, want) {
+		t.Errorf("vars changed to %v", vars)
+	}
+}
+
+type user struct {
+	Name    string
+	Friends []string
+}
+
+type key string
+
+func (u user) Greeting() string { return "hi " + u.Name }
+
+func (u *user) Count() int { return len(u.Friends) }
+
+func (u user) Best() (string, error) {
+	if len(u.Friends) == 0 {
+		return "", errors.New("no friends")
+	}
+	return u.Friends[0], nil
+}
+
+func (u user) Add(n int) int { return n }
+
+func (u user) Fail() int { panic("failed") }
+
+type owner struct {
+	hidden user
+}
+
+func TestMethods(t *testing.T) {
+	u := user{"ann", []string{"bob", "cy"}}
+	tests := []struct {
+		template string
+		data     interface{}
+		out      string
+		err      string
+	}{
+		{"{{ u.Greeting }} {{ u.Count }} {{ u.Best }}", c{"u": u}, "hi ann 2 bob", ""},
+		{"{{ u.Greeting }} {{ u.Count }}", c{"u": &u}, "hi ann 2", ""},
+		{"{{ Greeting }} {{ Count }} {{ Greeting }}", &u, "hi ann 2 hi ann", ""},
+		{"{{ Count }}", u, "2", ""},
+		{"{{ u.Add }}{{ u.Missing }}", c{"u": u}, "", ""},
+		{"{% for f in u.Best %}{{ f }}{% endfor %}", c{"u": u}, "bob", ""},
+		{"x{{ u.Best }}", c{"u": user{}}, "x", `1:7: u.Best: no friends`},
+		{"x{{ Best }}", user{}, "x", `1:5: Best: no friends`},
+		// methods that can't be called are missing
+		{"{{ u.Greeting }}{{ u.Name }}", c{"u": (*user)(nil)}, "", ""},
+		{"{{ Greeting }}", (*user)(nil), "", ""},
+		{"{{ u.Count }}", c{"u": (*user)(nil)}, "", ""},
+		{"{{ Count }}{{ Greeting }}", (*user)(nil), "", ""},
+		{"x{{ u.Fail }}", c{"u": u}, "x", `1:7: u.Fail: error calling Fail: failed`},
+		{"x{{ Fail }}", u, "x", `1:5: Fail: error calling Fail: failed`},
+		{"{{ o.hidden.Greeting }}{{ o.hidden.Name }}", c{"o": owner{u}}, "ann", ""},
+	}
+	for i, test := range tests {
+		temp := MustParseString(test.template)
+		var buf bytes.Buffer
+		err := temp.Execute(&buf, test.data)
+		if test.err == "" && err != nil {
+			t.Errorf("#%d got error %s", i, err)
+		} else if test.err != "" && (err == nil || err.Error() != test.err) {
+			t.Errorf("#%d got error %v want %s", i, err, test.err)
+		}
+		if buf.String() != test.out {
+			t.Errorf("#%d got %q want %q", i, buf.String(), test.out)
+		}
+	}
+}
+
+func TestExecuteData(t *testing.T) {
+	temp := MustParseString("{{ Name }}:{% for f in Friends %}{{ f }}{% endfor %}:{{ name }}")
+	u := user{"ann", []string{"bob", "cy"}}
+	tests := []struct {
+		data interface{}
+		out  string
+	}{
+		{u, "ann:bobcy:"},
+		{&u, "ann:bobcy:"},
+		{(*user)(nil), "::"},
+		{nil, "::"},
+		{map[string]string{"Name": "dee", "name": "x"}, "dee::x"},
+		{map[key]interface{}{"Friends": []int{1, 2}}, ":12:"},
+		{c{"Name": nil}, "::"},
+	}
+	for i, test := range tests {
+		var buf bytes.Buffer
+		if err := temp.Execute(&buf, test.data); err != nil {
+			t.Errorf("#%d: %s", i, err)
+		} else if buf.String() != test.out {
+			t.Errorf("#%d got %q want %q", i, buf.String(), test.out)
+		}
+	}
+	for _, data := range []interface{}{1, "x", []string{}, map[int]string{}} {
+		if err := temp.Execute(&bytes.Buffer{}, data); err == nil {
+			t.Errorf("%T: got no error", data)
+		}
+	}
+}
+
+func TestUndefined(t *testing.T) {
+	vars := c{"user": user{"ann", []string{"bob"}}, "m": c{"k": 1}, "nil": nil}
+	tests := []struct {
+		template string
+		err      string
+	}{
+		{"{{ usr }}", `1:4: undefined variable "usr"`},
+		{"{{ user.Name }}\n{{ user.Emial }}", `2:9: undefined attribute "user.Emial"`},
+		{"{{ user.Friends.1 }}", `1:17: undefined attribute "user.Friends.1"`},
+		{"{{ user.Name.Length }}", `1:14: undefined attribute "user.Name.Length"`},
+		{"{{ m.k.x }}", `1:8: undefined attribute "m.k.x"`},
+		{"{{ m.j|default:1 }}", `1:6: undefined attribute "m.j"`},
+		{"{% if x %}{% endif %}", `1:7: undefined variable "x"`},
+		{"{% for x in y %}{% endfor %}", `1:13: undefined variable "y"`},
+		{"{% for x in user.Friends %}{{ x.0 }}{% endfor %}{% set z 1 %}{{ z }}{{ nil }}", ""},
+		{"{% block b %}{{ block.super }}{{ block.sup }}{% endblock %}", `1:40: undefined attribute "block.sup"`},
+		{"{{ user.Friends[-1] }}{{ user.Friends[5] }}", `1:38: undefined attribute "user.Friends[5]"`},
+		{"{{ m[user.Name] }}", `1:5: undefined attribute "m[user.Name]"`},
+		{"{{ nope[1:] }}", `1:4: undefined variable "nope"`},
+		{"{{ nil[1:] }}", `1:7: undefined attribute "nil[1:]"`},
+	}
+	for i, test := range tests {
+		temp := MustParseString(test.template)
+		var buf bytes.Buffer
+		if err := temp.Execute(&buf, vars); err != nil {
+			t.Errorf("#%d failed without undefined=error: %s", i, err)
+		}
+		err := temp.ExecuteOptions(&buf, vars, "undefined=error")
+		if test.err == "" {
+			if err != nil {
+				t.Errorf("#%d got error %s", i, err)
+			}
+			continue
+		}
+		var eerr *ExecError
+		if !errors.As(err, &eerr) || err.Error() != test.err {
+			t.Errorf("#%d got error %v want %s", i, err, test.err)
+		}
+	}
+
+	env := NewEnvironment().Option("undefined=error")
+	temp, err := env.ParseString("{{ x }}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := temp.Execute(&bytes.Buffer{}, nil); err == nil {
+		t.Error("got no error with the option set on the Environment")
+	}
+}
+
+func TestSubscriptErrors(t *testing.T) {
+	tests := []struct {
+		template string
+		err      string
+	}{
+		{"{{ l[1.5:] }}", "1:5: slice index 1.5 isn't an integer"},
+		{"{{ l[:'a'] }}", "1:5: slice index 'a' isn't an integer"},
+		{"{{ m[1:] }}", "1:5: can't slice map[string]int"},
+		{"{{ u['Best'] }}", "1:5: u['Best']: no friends"},
+	}
+	for i, test := range tests {
+		temp := MustParseString(test.template)
+		err := temp.Execute(&bytes.Buffer{}, c{"l": []int{1}, "m": map[string]int{}, "u": user{}})
+		if err == nil || err.Error() != test.err {
+			t.Errorf("#%d got error %v want %s", i, err, test.err)
+		}
+	}
+
+	for _, src := range []string{"{{ l[] }}", "{{ l[1 }}", "{{ l[1:2:3] }}", "{{ l[1]] }}"} {
+		if _, err := ParseString(src); err == nil {
+			t.Errorf("%s: got no parse error", src)
+		}
+	}
+}
+
+func TestVariables(t *testing.T) {
+	env := NewEnvironment()
+	env.SetLoader(NewMapLoader(env, map[string]string{
+		"base":   "{{ title }}{% block body %}{% endblock %}{% include 'footer' %}",
+		"footer": "{{ site.name }}{% include 'base' %}",
+	}))
+	tests := []struct {
+		template  string
+		variables []string
+		paths     []string
+	}{
+		{"hello", []string{}, []string{}},
+		{"{{ b }}{{ a.x }}{{ a.y.z|default:c }}", []string{"a", "b", "c"}, []string{"a", "a.x", "a.y.z", "b", "c"}},
+		{"{% for u in users %}{{ u.name }}{{ n }}{% endfor %}", []string{"n", "users"}, []string{"n", "users"}},
+		{"{% set x 1 %}{{ x.y }}{% with %}{% set y 2 %}{{ y }}{% endwith %}", []string{}, []string{}},
+		{"{% extends 'base' %}{% block body %}{{ user.name }}{{ block.super }}{% endblock %}",
+			[]string{"user"}, []string{"user", "user.name"}},
+		{"{% include 'footer' %}{{ title }}", []string{"title"}, []string{"title"}},
+		{"{% include name %}", []string{"name"}, []string{"name"}},
+		{"{{ a.b[c.d].e }}{{ f[0] }}", []string{"a", "c", "f"}, []string{"a", "a.b", "c", "c.d", "f"}},
+	}
+	for i, test := range tests {
+		temp, err := env.ParseString(test.template)
+		if err != nil {
+			t.Errorf("#%d failed to parse: %s", i, err)
+			continue
+		}
+		if vars := temp.Variables(); !reflect.DeepEqual(vars, test.variables) {
+			t.Errorf("#%d got variables %q want %q", i, vars, test.variables)
+		}
+		if paths := temp.VariablePaths(); !reflect.DeepEqual(paths, test.paths) {
+			t.Errorf("#%d got paths %q want %q", i, paths, test.paths)
+		}
+	}
+}
+
 // Benchmark taken from here: http://code.google.com/p/spitfire/source/browse/trunk/tests/perf/bigtable.py
 var bench = `<table>
 {% for row in table %}
@@ -1,11 +1,19 @@
 package template
 
 import (
+	"fmt"
 	"io"
+	"math"
 	"reflect"
 	"strconv"
 )
 
+// writeString writes s to w and returns any error from the write.
+func writeString(w io.Writer, s string) error {
+	_, err := io.WriteString(w, s)
+	return err
+}
+
 // If v is a string, put it in single quotes.
 // Otherwise return the string normally.
 func quoteString(v Value) string {
@@ -15,8 +23,6 @@ func quoteString(v Value) string {
 	return v.String()
 }
 
-// TODO: should there be a Float method on Value?
-
 // A Value represents a generic value of any type.
 type Value interface {
 	Node
@@ -36,10 +42,15 @@ type Value interface {
 	//	- A bool that is true evaluates to 1; false evaluates to 0
 	//	- An integer evaluates to itself, with unsigned types possibly overflowing
 	//	- A string is converted to a signed integer if possible
-	//	- A non-nil pointer to one of the above types uses 
+	//	- A non-nil pointer to one of the above types uses
 	// All other values evaluate to 0.
 	Int() int64
 
+	// Float coerces the Value to a floating-point number. It uses the same
+	// rules as Int, except that a float evaluates to itself and a string is
+	// converted to a float if possible.
+	Float() float64
+
 	// String coerces the Value to a string. The return parameter follows these rules:
 	//	- A bool returns "true" if it is true and "false" otherwise
 	//	- An integer is converted to its string representation
@@ -59,12 +70,13 @@ type Value interface {
 
 type nilValue byte
 
-func (n nilValue) Bool() bool                      { return false }
-func (n nilValue) Int() int64                      { return 0 }
-func (n nilValue) String() string                  { return "" }
-func (n nilValue) Uint() uint64                    { return 0 }
-func (n nilValue) Reflect() reflect.Value          { return reflect.ValueOf(nil) }
-func (n nilValue) Render(wr io.Writer, c *Context) {}
+func (n nilValue) Bool() bool                            { return false }
+func (n nilValue) Int() int64                            { return 0 }
+func (n nilValue) Float() float64                        { return 0 }
+func (n nilValue) String() string                        { return "" }
+func (n nilValue) Uint() uint64                          { return 0 }
+func (n nilValue) Reflect() reflect.Value                { return reflect.ValueOf(nil) }
+func (n nilValue) Render(wr io.Writer, c *Context) error { return nil }
 
 type boolValue bool
 
@@ -77,6 +89,8 @@ func (b boolValue) Int() int64 {
 	return 0
 }
 
+func (b boolValue) Float() float64 { return float64(b.Int()) }
+
 func (b boolValue) String() string {
 	if b {
 		return "true"
@@ -91,8 +105,8 @@ func (b boolValue) Uint() uint64 {
 	return 0
 }
 
-func (b boolValue) Reflect() reflect.Value         { return reflect.ValueOf(b) }
-func (b boolValue) Render(w io.Writer, c *Context) { io.WriteString(w, b.String()) }
+func (b boolValue) Reflect() reflect.Value               { return reflect.ValueOf(b) }
+func (b boolValue) Render(w io.Writer, c *Context) error { return writeString(w, b.String()) }
 
 type stringValue string
 
@@ -105,6 +119,13 @@ func (str stringValue) Int() int64 {
 	return 0
 }
 
+func (str stringValue) Float() float64 {
+	if f, err := strconv.ParseFloat(string(str), 64); err == nil {
+		return f
+	}
+	return 0
+}
+
 func (str stringValue) String() string { return string(str) }
 
 func (str stringValue) Uint() uint64 {
@@ -114,32 +135,45 @@ func (str stringValue) Uint() uint64 {
 	return 0
 }
 
-func (str stringValue) Reflect() reflect.Value         { return reflect.ValueOf(str) }
-func (str stringValue) Render(w io.Writer, c *Context) { io.WriteString(w, string(str)) }
+func (str stringValue) Reflect() reflect.Value               { return reflect.ValueOf(str) }
+func (str stringValue) Render(w io.Writer, c *Context) error { return writeString(w, string(str)) }
 
 type intValue int64
 
-func (i intValue) Bool() bool                     { return i != 0 }
-func (i intValue) Int() int64                     { return int64(i) }
-func (i intValue) String() string                 { return strconv.FormatInt(int64(i), 10) }
-func (i intValue) Uint() uint64                   { return uint64(i) }
-func (i intValue) Reflect() reflect.Value         { return reflect.ValueOf(i) }
-func (i intValue) Render(w io.Writer, c *Context) { io.WriteString(w, i.String()) }
+func (i intValue) Bool() bool                           { return i != 0 }
+func (i intValue) Int() int64                           { return int64(i) }
+func (i intValue) Float() float64                       { return float64(i) }
+func (i intValue) String() string                       { return strconv.FormatInt(int64(i), 10) }
+func (i intValue) Uint() uint64                         { return uint64(i) }
+func (i intValue) Reflect() reflect.Value               { return reflect.ValueOf(i) }
+func (i intValue) Render(w io.Writer, c *Context) error { return writeString(w, i.String()) }
+
+type uintValue uint64
+
+func (u uintValue) Bool() bool                           { return u != 0 }
+func (u uintValue) Int() int64                           { return int64(u) }
+func (u uintValue) Float() float64                       { return float64(u) }
+func (u uintValue) String() string                       { return strconv.FormatUint(uint64(u), 10) }
+func (u uintValue) Uint() uint64                         { return uint64(u) }
+func (u uintValue) Reflect() reflect.Value               { return reflect.ValueOf(u) }
+func (u uintValue) Render(w io.Writer, c *Context) error { return writeString(w, u.String()) }
 
 type floatValue float64
 
 func (f floatValue) Bool() bool             { return f != 0 }
 func (f floatValue) Int() int64             { return int64(f) }
+func (f floatValue) Float() float64         { return float64(f) }
 func (f floatValue) String() string         { return strconv.FormatFloat(float64(f), 'g', -1, 64) }
 func (f floatValue) Uint() uint64           { return uint64(f) }
 func (f floatValue) Reflect() reflect.Value { return reflect.ValueOf(f) }
 
-func (f floatValue) Render(w io.Writer, c *Context) { io.WriteString(w, f.String()) }
+func (f floatValue) Render(w io.Writer, c *Context) error { return writeString(w, f.String()) }
 
 type complexValue complex128
 
-func (c complexValue) Bool() bool { return c != 0 }
-func (c complexValue) Int() int64 { return 0 }
+func (c complexValue) Bool() bool     { return c != 0 }
+func (c complexValue) Int() int64     { return 0 }
+func (c complexValue) Float() float64 { return 0 }
 
 func (c complexValue) String() string {
 	a, b := real(c), imag(c)
@@ -149,8 +183,8 @@ func (c complexValue) String() string {
 func (c complexValue) Uint() uint64           { return 0 }
 func (c complexValue) Reflect() reflect.Value { return reflect.ValueOf(c) }
 
-func (c complexValue) Render(w io.Writer, _ *Context) {
-	io.WriteString(w, c.String())
+func (c complexValue) Render(w io.Writer, _ *Context) error {
+	return writeString(w, c.String())
 }
 
 // reflectValue implements the common Value methods for reflected types.
@@ -158,6 +192,7 @@ type reflectValue reflect.Value
 
 func (v reflectValue) Bool() bool             { return reflect.Value(v).Len() != 0 }
 func (v reflectValue) Int() int64             { return 0 }
+func (v reflectValue) Float() float64         { return 0 }
 func (v reflectValue) Uint() uint64           { return 0 }
 func (v reflectValue) Reflect() reflect.Value { return reflect.Value(v) }
 
@@ -179,7 +214,7 @@ func (a arrayValue) String() string {
 	str += "]"
 	return str
 }
-func (a arrayValue) Render(w io.Writer, c *Context) { io.WriteString(w, a.String()) }
+func (a arrayValue) Render(w io.Writer, c *Context) error { return writeString(w, a.String()) }
 
 type mapValue struct {
 	reflectValue
@@ -204,7 +239,7 @@ func (m mapValue) String() string {
 	str += "}"
 	return str
 }
-func (m mapValue) Render(w io.Writer, c *Context) { io.WriteString(w, m.String()) }
+func (m mapValue) Render(w io.Writer, c *Context) error { return writeString(w, m.String()) }
 
 type chanValue struct {
 	reflectValue
@@ -214,7 +249,7 @@ func (ch chanValue) String() string {
 	// TODO: implement
 	return ""
 }
-func (ch chanValue) Render(w io.Writer, c *Context) { io.WriteString(w, ch.String()) }
+func (ch chanValue) Render(w io.Writer, c *Context) error { return writeString(w, ch.String()) }
 
 type structValue struct {
 	reflectValue
@@ -225,13 +260,37 @@ func (st structValue) String() string {
 	// TODO: implement
 	return ""
 }
-func (st structValue) Render(w io.Writer, c *Context) { io.WriteString(w, st.String()) }
+func (st structValue) Render(w io.Writer, c *Context) error { return writeString(w, st.String()) }
 
 type pointerValue struct {
 	reflectValue
 }
 
 func (p pointerValue) value() Value { return refToVal(reflect.Value(p.reflectValue).Elem()) }
+func (p pointerValue) isNil() bool  { return reflect.Value(p.reflectValue).IsNil() }
+
+// Int, Uint and Float follow the element, so that pointers to numbers
+// work in arithmetic and with filters taking numbers.
+func (p pointerValue) Int() int64 {
+	if p.isNil() {
+		return 0
+	}
+	return p.value().Int()
+}
+
+func (p pointerValue) Uint() uint64 {
+	if p.isNil() {
+		return 0
+	}
+	return p.value().Uint()
+}
+
+func (p pointerValue) Float() float64 {
+	if p.isNil() {
+		return 0
+	}
+	return p.value().Float()
+}
 
 // TODO: correct
 func (p pointerValue) Bool() bool { return !reflect.Value(p.reflectValue).IsNil() }
@@ -241,7 +300,12 @@ func (p pointerValue) String() string {
 	}
 	return p.value().String()
 }
-func (p pointerValue) Render(w io.Writer, c *Context) { io.WriteString(w, p.String()) }
+func (p pointerValue) Render(w io.Writer, c *Context) error { return writeString(w, p.String()) }
+
+// ValueOf returns a Value holding i.
+func ValueOf(i interface{}) Value {
+	return refToVal(reflect.ValueOf(i))
+}
 
 // A Variable is an index into a Context's stack.
 // Variables must be obtained through the Parser before runtime.
@@ -264,7 +328,7 @@ func refToVal(ref reflect.Value) Value {
 		return intValue(ref.Int())
 	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32,
 		reflect.Uint64, reflect.Uintptr:
-		return intValue(ref.Uint())
+		return uintValue(ref.Uint())
 	case reflect.Float32, reflect.Float64:
 		return floatValue(ref.Float())
 	case reflect.Complex64, reflect.Complex128:
@@ -278,9 +342,14 @@ func refToVal(ref reflect.Value) Value {
 	case reflect.Ptr:
 		return pointerValue{reflectValue(ref)}
 	case reflect.String:
+		if ref.Type() == safeStringType {
+			return SafeString(ref.String())
+		}
 		return stringValue(ref.String())
 	case reflect.Struct:
 		return structValue{reflectValue(ref)}
+	case reflect.Interface:
+		return refToVal(ref.Elem())
 	}
 	return nilValue(0)
 }
@@ -290,14 +359,14 @@ func lookup(v reflect.Value, s string) reflect.Value {
 	v = reflect.Indirect(v)
 	switch v.Kind() {
 	case reflect.Array, reflect.Slice:
-		if idx, err := strconv.Atoi(s); err == nil {
+		if idx, err := strconv.Atoi(s); err == nil && 0 <= idx && idx < v.Len() {
 			ret = v.Index(idx)
 		}
 	case reflect.Map:
 		keyt := v.Type().Key()
 		switch keyt.Kind() {
 		case reflect.String:
-			ret = v.MapIndex(reflect.ValueOf(s))
+			ret = v.MapIndex(reflect.ValueOf(s).Convert(keyt))
 		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
 			if idx, err := strconv.ParseInt(s, 10, 64); err == nil {
 				idxVal := reflect.New(keyt).Elem()
@@ -314,6 +383,124 @@ func lookup(v reflect.Value, s string) reflect.Value {
 	case reflect.Struct:
 		ret = v.FieldByName(s)
 	}
-	// TODO: Find a way to look up methods by name
 	return ret
 }
+
+// index returns the element of v for the subscript key, or the zero Value
+// if there's no such element. Strings, by rune, slices and arrays are
+// indexed by integers, counting from the end if they're negative. Maps are
+// indexed by the key equal to key, as found by the in operator. Any other
+// key is looked up like an attribute named by its string.
+func index(v reflect.Value, key Value) (reflect.Value, error) {
+	v = reflect.Indirect(v)
+	switch v.Kind() {
+	case reflect.String:
+		if i, ok := intKey(key); ok {
+			runes := []rune(v.String())
+			if i, ok := seqIndex(i, len(runes)); ok {
+				return reflect.ValueOf(string(runes[i])), nil
+			}
+			return reflect.Value{}, nil
+		}
+	case reflect.Array, reflect.Slice:
+		if i, ok := intKey(key); ok {
+			if i, ok := seqIndex(i, v.Len()); ok {
+				return v.Index(i), nil
+			}
+			return reflect.Value{}, nil
+		}
+	case reflect.Map:
+		if k := mapKey(v, key); k.IsValid() {
+			return v.MapIndex(k), nil
+		}
+	}
+	return lookupAttr(v, key.String())
+}
+
+// intKey returns key as an integer index, or false if it isn't an integer.
+func intKey(key Value) (int64, bool) {
+	key, kind := cmpKindOf(key)
+	switch {
+	case kind != cmpNumber && kind != cmpBool, numKindOf(key) == numFloat:
+		return 0, false
+	case numKindOf(key) == numUint && key.Uint() > math.MaxInt64:
+		return math.MaxInt64, true
+	}
+	return key.Int(), true
+}
+
+// seqIndex returns the index i of a sequence of length n, counting from the
+// end if it's negative, or false if it's out of range.
+func seqIndex(i int64, n int) (int, bool) {
+	if i < 0 {
+		i += int64(n)
+	}
+	if i < 0 || i >= int64(n) {
+		return 0, false
+	}
+	return int(i), true
+}
+
+// lookupAttr is like lookup, but falls back to calling the method of v
+// called s.
+func lookupAttr(v reflect.Value, s string) (reflect.Value, error) {
+	if ret := lookup(v, s); ret.IsValid() {
+		return ret, nil
+	}
+	return callMethod(v, s)
+}
+
+// callMethod calls the method of v called name and returns its result. The
+// method may have a value or pointer receiver, must take no arguments, and
+// must return a single value, optionally followed by an error, which
+// callMethod returns. If there's no such method, or it can't be called
+// because v is a nil pointer or was read from an unexported field,
+// callMethod returns the zero Value. A panic in the method is returned as
+// an error.
+func callMethod(v reflect.Value, name string) (ret reflect.Value, err error) {
+	if v.Kind() == reflect.Interface {
+		v = v.Elem()
+	}
+	if !v.IsValid() || !v.CanInterface() {
+		return reflect.Value{}, nil
+	}
+	if v.Kind() == reflect.Ptr && v.IsNil() {
+		// a value receiver can't be read through a nil pointer, and
+		// methods with pointer receivers mostly don't expect nil either
+		return reflect.Value{}, nil
+	}
+	m := v.MethodByName(name)
+	if !m.IsValid() && v.Kind() != reflect.Ptr && v.Kind() != reflect.Interface {
+		// look for a method with a pointer receiver
+		p := v
+		if v.CanAddr() {
+			p = v.Addr()
+		} else {
+			p = reflect.New(v.Type())
+			p.Elem().Set(v)
+		}
+		m = p.MethodByName(name)
+	}
+	if !m.IsValid() || !isGetter(m.Type(), 0) {
+		return reflect.Value{}, nil
+	}
+	defer func() {
+		if e := recover(); e != nil {
+			ret, err = reflect.Value{}, fmt.Errorf("error calling %s: %v", name, e)
+		}
+	}()
+	out := m.Call(nil)
+	if len(out) == 2 && !out[1].IsNil() {
+		return reflect.Value{}, out[1].Interface().(error)
+	}
+	return out[0], nil
+}
+
+// isGetter reports whether a function of type t, whose first in parameters
+// are receivers, can be called by callMethod.
+func isGetter(t reflect.Type, in int) bool {
+	if t.NumIn() != in {
+		return false
+	}
+	return t.NumOut() == 1 || t.NumOut() == 2 && t.Out(1) == errorType
+}